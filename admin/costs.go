@@ -0,0 +1,54 @@
+package admin
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"appengine"
+
+	"job"
+)
+
+var (
+	costsTemplate = template.Must(template.ParseFiles("admin/costs.html"))
+)
+
+func init() {
+	http.HandleFunc("/admin/costs", costsHandler)
+}
+
+func costsHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	day := time.Now()
+	if r.FormValue("day") != "" {
+		var err error
+		day, err = time.Parse("2006-01-02", r.FormValue("day"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := job.DailyCostReport(c, day)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = costsTemplate.Execute(w, struct {
+		Report  *job.CostReport
+		PrevDay string
+		NextDay string
+	}{
+		report,
+		report.Day.AddDate(0, 0, -1).Format("2006-01-02"),
+		report.Day.AddDate(0, 0, 1).Format("2006-01-02"),
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
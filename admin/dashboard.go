@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"appengine"
+
+	"job"
+)
+
+var (
+	dashboardTemplate = template.Must(template.New("dashboard.html").
+		Funcs(template.FuncMap{
+			"since":    since,
+			"duration": roundDuration,
+		}).
+		ParseFiles("admin/dashboard.html"))
+)
+
+func init() {
+	http.HandleFunc("/admin/", dashboardHandler)
+	http.HandleFunc("/admin/dashboard/terminate_instance", terminateInstanceHandler)
+	http.HandleFunc("/admin/dashboard/fail_job", failJobHandler)
+}
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/admin/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	c := appengine.NewContext(r)
+
+	recentJobs, err := job.RecentJobs(c, 50)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	poolInstances, err := job.PoolInstances(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	holdingJobs, err := job.JobsHoldingInstances(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	logs, err := job.RecentJobLogs(c, 50)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = dashboardTemplate.Execute(w, struct {
+		RecentJobs    []*job.State
+		PoolInstances []*job.PoolInstance
+		HoldingJobs   []*job.State
+		Logs          []job.JobLogEntry
+	}{
+		recentJobs,
+		poolInstances,
+		holdingJobs,
+		logs,
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func terminateInstanceHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "Termination must be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := appengine.NewContext(r)
+	if err := job.TerminatePoolInstance(c, r.FormValue("id")); err != nil {
+		if err == job.ErrNotInPool {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/", http.StatusFound)
+}
+
+func failJobHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "Failing a job must be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := appengine.NewContext(r)
+	if err := job.Fail(c, r.FormValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/", http.StatusFound)
+}
+
+// Returns how long ago the given time was, to the second.
+func since(t time.Time) time.Duration {
+	return roundDuration(time.Since(t))
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d - d%time.Second
+}
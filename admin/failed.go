@@ -0,0 +1,60 @@
+package admin
+
+import (
+	"html/template"
+	"net/http"
+
+	"appengine"
+
+	"job"
+)
+
+var (
+	failedTemplate = template.Must(template.ParseFiles("admin/failed.html"))
+)
+
+func init() {
+	http.HandleFunc("/admin/failed", failedHandler)
+	http.HandleFunc("/admin/failed/replay", failedReplayHandler)
+}
+
+func failedHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	cause := job.FailureCause(r.FormValue("cause"))
+	jobs, err := job.FailedJobs(c, cause, 100)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = failedTemplate.Execute(w, struct {
+		Causes []job.FailureCause
+		Jobs   []*job.State
+	}{
+		job.FailureCauses,
+		jobs,
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func failedReplayHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "Replay must be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := appengine.NewContext(r)
+	id := r.FormValue("id")
+	if err := job.Replay(c, id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/job/"+id, http.StatusFound)
+}
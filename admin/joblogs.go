@@ -0,0 +1,59 @@
+package admin
+
+import (
+	"html/template"
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+
+	"job"
+)
+
+var (
+	jobLogsTemplate = template.Must(template.ParseFiles("admin/joblogs.html"))
+)
+
+func init() {
+	http.HandleFunc("/admin/job_logs", jobLogsHandler)
+}
+
+func jobLogsHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	state := &job.State{ID: r.FormValue("id")}
+	if err := datastore.Get(c, state.GetKey(c), state); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	query := r.FormValue("q")
+	entries, err := state.SearchLogs(c, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	deliveries, err := state.WebhookDeliveries(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = jobLogsTemplate.Execute(w, struct {
+		Job        *job.State
+		Query      string
+		Entries    []job.LogEntry
+		Deliveries []job.WebhookDelivery
+	}{
+		state,
+		query,
+		entries,
+		deliveries,
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"appengine"
+
+	"job"
+)
+
+var (
+	latencyTemplate = template.Must(template.New("latency.html").
+			Funcs(template.FuncMap{"duration": roundDuration}).
+			ParseFiles("admin/latency.html"))
+
+	latencyPercentiles = []float64{50, 90, 99}
+)
+
+func init() {
+	http.HandleFunc("/admin/latency", latencyHandler)
+}
+
+func latencyHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	stages, total, err := job.LatencyPercentiles(c, 100, latencyPercentiles)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = latencyTemplate.Execute(w, struct {
+		Percentiles []float64
+		Stages      []job.StageLatency
+		Total       []time.Duration
+	}{
+		latencyPercentiles,
+		stages,
+		total,
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
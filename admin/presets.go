@@ -0,0 +1,167 @@
+package admin
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+
+	"job"
+	"storage"
+)
+
+var (
+	presetsTemplate = template.Must(template.ParseFiles("admin/presets.html"))
+)
+
+func init() {
+	http.HandleFunc("/admin/presets", presetsHandler)
+	http.HandleFunc("/admin/presets/save", presetSaveHandler)
+	http.HandleFunc("/admin/presets/delete", presetDeleteHandler)
+	http.HandleFunc("/admin/presets/guide", presetGuideHandler)
+}
+
+type presetUses struct {
+	*job.Preset
+	Uses int
+}
+
+// Lists presets, with how often each has been used,
+// and a form for creating one, or editing the one named in the query.
+func presetsHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	presets, err := job.Presets(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]presetUses, len(presets))
+	for i, p := range presets {
+		uses, err := p.Uses(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list[i] = presetUses{p, uses}
+	}
+
+	editing := &job.Preset{}
+	if name := r.FormValue("name"); name != "" {
+		if editing, err = job.GetPreset(c, name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	saveURL, err := storage.GetUploadURL(c, "/admin/presets/save")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = presetsTemplate.Execute(w, struct {
+		Presets []presetUses
+		Editing *job.Preset
+		SaveURL *url.URL
+	}{
+		list,
+		editing,
+		saveURL,
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func presetSaveHandler(w http.ResponseWriter, r *http.Request) {
+
+	guideName, other, err := storage.HandleOptionalUpload(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c := appengine.NewContext(r)
+
+	// Saving under an existing name changes that preset.
+	name := other.Get("name")
+	preset, err := job.GetPreset(c, name)
+	if err == datastore.ErrNoSuchEntity {
+		preset = &job.Preset{Name: name}
+	} else if _, ok := err.(*job.ValidationError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	preset.Description = other.Get("description")
+	preset.Params = other.Get("params")
+	if guideName != "" {
+		preset.GuideData = guideName
+	} else if other.Get("remove_guide") != "" {
+		preset.GuideData = ""
+	}
+
+	if err := job.SavePreset(c, preset); err != nil {
+		if _, ok := err.(*job.ValidationError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/presets", http.StatusFound)
+}
+
+func presetDeleteHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "Delete must be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := appengine.NewContext(r)
+	if err := job.DeletePreset(c, r.FormValue("name")); err != nil {
+		if _, ok := err.(*job.ValidationError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/presets", http.StatusFound)
+}
+
+func presetGuideHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	preset, err := job.GetPreset(c, r.FormValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if preset.GuideData == "" {
+		http.Error(w, "No guide image", http.StatusNotFound)
+		return
+	}
+
+	blobKey, err := blobstore.BlobKeyForFile(c, preset.GuideData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	blobstore.Send(w, blobKey)
+}
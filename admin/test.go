@@ -4,8 +4,10 @@ import (
 	"html/template"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"appengine"
+	"appengine/user"
 
 	"job"
 	"storage"
@@ -19,6 +21,8 @@ var (
 func init() {
 	http.HandleFunc("/admin/test", testHandler)
 	http.HandleFunc("/job/create", jobCreateHandler)
+	http.HandleFunc("/batch/create", batchCreateHandler)
+	http.HandleFunc("/animation/create", animationCreateHandler)
 }
 
 func testHandler(w http.ResponseWriter, r *http.Request) {
@@ -30,10 +34,33 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 
+	batchUploadUrl, err := storage.GetUploadURL(c, "/batch/create")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	animationUploadUrl, err := storage.GetUploadURL(c, "/animation/create")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	presets, err := job.Presets(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
 	err = testTemplate.Execute(w, struct {
-		JobCreateURL *url.URL
+		JobCreateURL       *url.URL
+		BatchCreateURL     *url.URL
+		AnimationCreateURL *url.URL
+		MaxBatchJobs       int
+		Presets            []*job.Preset
 	}{
 		imageUploadUrl,
+		batchUploadUrl,
+		animationUploadUrl,
+		job.MaxBatchJobs,
+		presets,
 	})
 
 	if err != nil {
@@ -43,14 +70,58 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 
 func jobCreateHandler(w http.ResponseWriter, r *http.Request) {
 
-	storageName, _, err := storage.HandleUpload(r)
+	storageName, guideName, other, err := storage.HandleGuidedUpload(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	c := appengine.NewContext(r)
-	id, err := job.Create(c, storageName)
+
+	// Without an uploaded image, we import one from the URL given instead.
+	if storageName == "" {
+		sourceURL := other.Get("source_url")
+		if sourceURL == "" {
+			http.Error(w, "No file uploaded.", http.StatusBadRequest)
+			return
+		}
+		if storageName, err = storage.ImportURL(c, sourceURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	options := job.Options{
+		CallbackURL: other.Get("callback_url"),
+		NotifyEmail: other.Get("notify_email"),
+		GuideData:   guideName,
+		Preset:      other.Get("preset"),
+	}
+	if zoom := other.Get("zoom_iterations"); zoom != "" {
+		if options.ZoomIterations, err = strconv.Atoi(zoom); err != nil {
+			http.Error(w, "Zoom passes must be a number.", http.StatusBadRequest)
+			return
+		}
+	}
+	if options.Pipeline, err = job.ParsePipeline(other.Get("pipeline")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if scale := other.Get("zoom_scale"); scale != "" {
+		if options.ZoomScale, err = strconv.ParseFloat(scale, 64); err != nil {
+			http.Error(w, "Zoom scale must be a number.", http.StatusBadRequest)
+			return
+		}
+	}
+	if u := user.Current(c); u != nil {
+		options.User = u.Email
+	}
+
+	id, err := job.Create(c, storageName, options)
+	if _, ok := err.(*job.ValidationError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -58,3 +129,57 @@ func jobCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 	http.Redirect(w, r, "/job/" + id, http.StatusFound)
 }
+
+func batchCreateHandler(w http.ResponseWriter, r *http.Request) {
+
+	storageNames, other, err := storage.HandleUploads(r, job.MaxBatchJobs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c := appengine.NewContext(r)
+
+	options := job.Options{
+		Preset: other.Get("preset"),
+	}
+	if u := user.Current(c); u != nil {
+		options.User = u.Email
+	}
+
+	id, err := job.CreateBatch(c, storageNames, options)
+	if _, ok := err.(*job.ValidationError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/batch/"+id, http.StatusFound)
+}
+
+func animationCreateHandler(w http.ResponseWriter, r *http.Request) {
+
+	storageName, other, err := storage.HandleUpload(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c := appengine.NewContext(r)
+
+	var options job.Options
+	if u := user.Current(c); u != nil {
+		options.User = u.Email
+	}
+
+	id, err := job.CreateAnimation(c, storageName, options, other.Get("seed") != "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/animation/"+id, http.StatusFound)
+}
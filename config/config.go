@@ -3,6 +3,8 @@ package config
 import (
 	"encoding/json"
 	"io/ioutil"
+	"strconv"
+	"time"
 )
 
 
@@ -22,3 +24,45 @@ func init() {
 func Get(key string) string {
 	return config[key]
 }
+
+// Returns the given key as an integer, or def if it isn't set.
+func GetInt(key string, def int) int {
+	if config[key] == "" {
+		return def
+	}
+
+	value, err := strconv.Atoi(config[key])
+	if err != nil {
+		panic("Unable to parse " + key + " as an integer: " + err.Error())
+	}
+
+	return value
+}
+
+// Returns the given key as a floating point number, or def if it isn't set.
+func GetFloat(key string, def float64) float64 {
+	if config[key] == "" {
+		return def
+	}
+
+	value, err := strconv.ParseFloat(config[key], 64)
+	if err != nil {
+		panic("Unable to parse " + key + " as a number: " + err.Error())
+	}
+
+	return value
+}
+
+// Returns the given key as a duration, such as "30s", or def if it isn't set.
+func GetDuration(key string, def time.Duration) time.Duration {
+	if config[key] == "" {
+		return def
+	}
+
+	value, err := time.ParseDuration(config[key])
+	if err != nil {
+		panic("Unable to parse " + key + " as a duration: " + err.Error())
+	}
+
+	return value
+}
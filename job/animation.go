@@ -0,0 +1,628 @@
+package job
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+
+	"config"
+	"storage"
+)
+
+// Animated GIFs are dreamed a frame at a time.
+//
+// We split the GIF into frames, and dream each frame as a job in a batch
+// with the same ID as the animation. Frames may be seeded with the
+// previous frame's dream, blended into their input, so features carry
+// over between frames rather than flickering; seeded frames are
+// necessarily dreamed one at a time. Once every frame has finished,
+// we put the dreams back together into a GIF with the original timing.
+//
+// Video isn't supported, since we've no way to decode it here,
+// so has to be converted to a GIF first.
+//
+// GIFs are decoded and encoded with every frame at once, so we limit
+// the pixels in an animation, checking before we decode an upload,
+// which bounds the memory needed to split it and to assemble it.
+
+var (
+	// The most frames we accept in an animation.
+	maxAnimationFrames = config.GetInt("ANIMATION_MAX_FRAMES", 100)
+
+	// The most pixels we accept in an animation, across all its frames.
+	maxAnimationPixels = config.GetInt("ANIMATION_MAX_PIXELS", 32<<20)
+
+	// How much of the previous frame's dream makes up a seeded frame's input,
+	// from zero to one.
+	animationSeedWeight = config.GetFloat("ANIMATION_SEED_WEIGHT", 0.3)
+)
+
+type AnimationStatus int
+
+const (
+	AnimationSplitting AnimationStatus = iota
+	AnimationDreaming
+	AnimationDone
+	AnimationFailed
+)
+
+func (status AnimationStatus) Description() string {
+	switch status {
+	case AnimationSplitting:
+		return "Splitting animation into frames..."
+	case AnimationDreaming:
+		return "Dreaming frames..."
+	case AnimationDone:
+		return "Finished."
+	case AnimationFailed:
+		return "Failed to process animation."
+	}
+
+	return "Status is unknown."
+}
+
+func (status AnimationStatus) String() string {
+	switch status {
+	case AnimationSplitting:
+		return "splitting"
+	case AnimationDreaming:
+		return "dreaming"
+	case AnimationDone:
+		return "done"
+	case AnimationFailed:
+		return "failed"
+	}
+
+	return "unknown"
+}
+
+// An animation being dreamed a frame at a time.
+type Animation struct {
+
+	// The unique ID of this animation, shared with the batch of its frames.
+	ID string
+
+	// How far processing the animation has got.
+	Status AnimationStatus
+
+	// The time the animation was created.
+	CreateTime time.Time
+
+	// The time the animation was finished or failed. Zero if it's neither yet.
+	FinishTime time.Time
+
+	// The user who created the animation. Empty if they weren't logged in.
+	User string
+
+	// The cloud storage object of the GIF uploaded.
+	InputData string
+
+	// Whether each frame is seeded with the previous frame's dream.
+	SeedFromPrevious bool
+
+	// The number of frames in the animation, once split.
+	FrameCount int
+
+	// How long each frame is shown for, in hundredths of a second.
+	Delays []int `datastore:",noindex"`
+
+	// The GIF loop count; zero loops forever.
+	LoopCount int
+
+	// The cloud storage object of the assembled GIF.
+	OutputData string
+
+	// Why the animation failed, if it has.
+	FailureMessage string `datastore:",noindex"`
+}
+
+func (a *Animation) GetKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Animation", a.ID, 0, nil)
+}
+
+// Returns the ID of the job dreaming the given frame of an animation.
+// These are fixed, so splitting an animation more than once
+// doesn't create more than one job per frame.
+func frameJobID(animationID string, frame int) string {
+	return fmt.Sprintf("%s-%03d", animationID, frame)
+}
+
+// Create an animation from an uploaded GIF, and schedule it to be split
+// into frames and dreamed. Frames are created with the given user,
+// but don't notify anyone themselves.
+func CreateAnimation(c appengine.Context, inputData string, options Options,
+	seedFromPrevious bool) (id string, err error) {
+
+	id, err = generateRandStr(64)
+	if err != nil {
+		return "", err
+	}
+
+	a := &Animation{
+		ID:               id,
+		Status:           AnimationSplitting,
+		CreateTime:       time.Now(),
+		User:             options.User,
+		InputData:        inputData,
+		SeedFromPrevious: seedFromPrevious,
+	}
+
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, a.GetKey(c), a); err != nil {
+			return err
+		}
+
+		splitAnimationDelay.Call(c, id)
+		return nil
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+var splitAnimationDelay = delay.Func("splitAnimation", splitAnimation)
+
+// Split an animation into frames, and create a batch of jobs dreaming them.
+func splitAnimation(c appengine.Context, id string) error {
+
+	a := &Animation{ID: id}
+	if err := datastore.Get(c, a.GetKey(c), a); err != nil {
+		return err
+	}
+	if a.Status != AnimationSplitting {
+		return nil
+	}
+
+	g, failure, err := readAnimation(c, a.InputData)
+	if err != nil {
+		return err
+	}
+	if failure != "" {
+		return finishAnimation(c, id, "", failure)
+	}
+
+	inputData := make([]string, len(g.Image))
+	err = eachFrame(g, func(i int, frame image.Image) error {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, frame); err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("animation/%s/frame-%03d", id, i)
+		inputData[i], err = storage.WriteFile(c, name, buf.Bytes())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	states, err := newBatchStates(id, inputData, Options{User: a.User})
+	if err != nil {
+		return err
+	}
+	for i, state := range states {
+		state.ID = frameJobID(id, i)
+	}
+
+	batch := &Batch{
+		ID:               id,
+		CreateTime:       time.Now(),
+		User:             a.User,
+		Animation:        true,
+		SeedFromPrevious: a.SeedFromPrevious,
+	}
+	return createBatch(c, batch, states, func(c appengine.Context) error {
+		if err := datastore.Get(c, a.GetKey(c), a); err != nil {
+			return err
+		}
+		if a.Status != AnimationSplitting {
+			return errors.New("Animation has already been split.")
+		}
+
+		a.Status = AnimationDreaming
+		a.FrameCount = len(g.Image)
+		a.Delays = g.Delay
+		a.LoopCount = g.LoopCount
+
+		_, err := datastore.Put(c, a.GetKey(c), a)
+		return err
+	})
+}
+
+// Read and decode an uploaded GIF, checking it's within our limits first,
+// so we never decode more than we accept. If it isn't, or isn't a GIF,
+// returns why, rather than an error.
+func readAnimation(c appengine.Context, gsPath string) (g *gif.GIF, failure string, err error) {
+
+	rc, err := storage.OpenFile(c, gsPath)
+	if err != nil {
+		return nil, "", err
+	}
+	cfg, err := gif.DecodeConfig(rc)
+	rc.Close()
+	if err != nil {
+		return nil, "Couldn't read animation; only GIFs are supported: " + err.Error(), nil
+	}
+
+	area := cfg.Width * cfg.Height
+	if area > maxAnimationPixels {
+		return nil, fmt.Sprintf("Animation is %dx%d; the most pixels we accept is %d.",
+			cfg.Width, cfg.Height, maxAnimationPixels), nil
+	}
+
+	// Count the frames without decoding them, stopping once there are too many.
+	maxFrames := maxAnimationFrames
+	if area > 0 && maxAnimationPixels/area < maxFrames {
+		maxFrames = maxAnimationPixels / area
+	}
+	rc, err = storage.OpenFile(c, gsPath)
+	if err != nil {
+		return nil, "", err
+	}
+	frames, err := countGIFFrames(rc, maxFrames)
+	rc.Close()
+	if err != nil {
+		return nil, "Couldn't read animation; only GIFs are supported: " + err.Error(), nil
+	}
+	if frames > maxAnimationFrames {
+		return nil, fmt.Sprintf("Animation has more than %d frames, the most we accept.",
+			maxAnimationFrames), nil
+	}
+	if frames > maxFrames {
+		return nil, fmt.Sprintf("Animation has more than %d pixels across its frames, the most we accept.",
+			maxAnimationPixels), nil
+	}
+
+	rc, err = storage.OpenFile(c, gsPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+
+	g, err = gif.DecodeAll(rc)
+	if err != nil {
+		return nil, "Couldn't read animation; only GIFs are supported: " + err.Error(), nil
+	}
+
+	return g, "", nil
+}
+
+// Count the frames of a GIF by skipping over its blocks, without decoding
+// any of them. Stops once there are more than max, returning max+1.
+func countGIFFrames(r io.Reader, max int) (frames int, err error) {
+
+	br := bufio.NewReader(r)
+	skip := func(n int64) error {
+		_, err := io.CopyN(ioutil.Discard, br, n)
+		return err
+	}
+	skipSubBlocks := func() error {
+		for {
+			size, err := br.ReadByte()
+			if err != nil || size == 0 {
+				return err
+			}
+			if err := skip(int64(size)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The header and logical screen descriptor, then any global color table.
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, err
+	}
+	if flags := header[10]; flags&0x80 != 0 {
+		if err := skip(3 << (flags&0x07 + 1)); err != nil {
+			return 0, err
+		}
+	}
+
+	for {
+		block, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch block {
+		case 0x21: // Extension, with its label.
+			if _, err := br.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+
+		case 0x2C: // Image descriptor, then any local color table and the image data.
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return 0, err
+			}
+			if flags := descriptor[8]; flags&0x80 != 0 {
+				if err := skip(3 << (flags&0x07 + 1)); err != nil {
+					return 0, err
+				}
+			}
+			if _, err := br.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+
+			frames++
+			if frames > max {
+				return frames, nil
+			}
+
+		case 0x3B: // Trailer.
+			return frames, nil
+
+		default:
+			return 0, fmt.Errorf("unknown GIF block type 0x%02x", block)
+		}
+	}
+}
+
+// Call f with each frame of the GIF in turn, drawn in full
+// over the frames before it. f must not keep the frame it's given,
+// since it's reused for the next.
+func eachFrame(g *gif.GIF, f func(i int, frame image.Image) error) error {
+
+	bounds := animationBounds(g)
+	canvas := image.NewRGBA(bounds)
+	previous := image.NewRGBA(bounds)
+	for i, frame := range g.Image {
+
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if err := f(i, canvas); err != nil {
+			return err
+		}
+
+		// Leave the canvas as the frame asked it to be left for the next.
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous.Pix)
+		}
+	}
+
+	return nil
+}
+
+// Returns the bounds of the GIF's frames, once drawn in full.
+func animationBounds(g *gif.GIF) image.Rectangle {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+	return bounds
+}
+
+// Blend the previous frame's dream into a frame's input,
+// returning the cloud storage object of the result.
+// Returns an empty string if the frame isn't to be seeded,
+// as for the first frame, or if the previous frame has no dream.
+func seedFromPrevious(c appengine.Context, s *State) (inputData string, err error) {
+
+	if s.BatchIndex == 0 {
+		return "", nil
+	}
+
+	prev := &State{ID: frameJobID(s.BatchID, s.BatchIndex-1)}
+	if err := datastore.Get(c, prev.GetKey(c), prev); err != nil {
+		return "", err
+	}
+	if prev.Status != StatusDone {
+		c.Warningf("Previous frame didn't finish, so not seeding frame.")
+		return "", nil
+	}
+
+	frame, err := readImage(c, s.InputData)
+	if err != nil {
+		return "", err
+	}
+	seed, err := readImage(c, prev.OutputData)
+	if err != nil {
+		return "", err
+	}
+	if !frame.Bounds().Eq(seed.Bounds()) {
+		c.Warningf("Previous frame's dream is %v, but frame is %v, so not seeding frame.",
+			seed.Bounds(), frame.Bounds())
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, blendImages(frame, seed, animationSeedWeight)); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("animation/%s/seeded-%03d", s.BatchID, s.BatchIndex)
+	return storage.WriteFile(c, name, buf.Bytes())
+}
+
+// Returns a mix of two images of the same bounds,
+// taking the given fraction of each pixel from b.
+func blendImages(a, b image.Image, weight float64) image.Image {
+
+	bounds := a.Bounds()
+	out := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ca := color.RGBAModel.Convert(a.At(x, y)).(color.RGBA)
+			cb := color.RGBAModel.Convert(b.At(x, y)).(color.RGBA)
+			out.SetRGBA(x, y, color.RGBA{
+				R: blendChannel(ca.R, cb.R, weight),
+				G: blendChannel(ca.G, cb.G, weight),
+				B: blendChannel(ca.B, cb.B, weight),
+				A: blendChannel(ca.A, cb.A, weight),
+			})
+		}
+	}
+
+	return out
+}
+
+func blendChannel(a, b uint8, weight float64) uint8 {
+	return uint8(float64(a)*(1-weight) + float64(b)*weight + 0.5)
+}
+
+func readImage(c appengine.Context, gsPath string) (image.Image, error) {
+	rc, err := storage.OpenFile(c, gsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	img, _, err := image.Decode(rc)
+	return img, err
+}
+
+// Put the dreamed frames of an animation together into a GIF,
+// once they've all finished, or fail it if any frame failed.
+func assembleAnimation(c appengine.Context, id string) error {
+
+	a := &Animation{ID: id}
+	if err := datastore.Get(c, a.GetKey(c), a); err != nil {
+		return err
+	}
+	if a.Status != AnimationDreaming {
+		return nil
+	}
+
+	jobs, err := (&Batch{ID: id}).Jobs(c)
+	if err != nil {
+		return err
+	}
+	if len(jobs) < a.FrameCount {
+		return errors.New("Not every frame of the animation has been found yet.")
+	}
+
+	progress := NewBatchProgress(jobs)
+	if progress.Queued > 0 || progress.Running > 0 {
+		return nil
+	}
+	if progress.Failed > 0 {
+		return finishAnimation(c, id, "",
+			fmt.Sprintf("%d of %d frames failed to dream.", progress.Failed, progress.Total))
+	}
+
+	frames := make([]string, len(jobs))
+	for i, s := range jobs {
+		frames[i] = s.OutputData
+	}
+
+	outputData, err := writeAnimation(c, "animation/"+id+"/output", frames, a.Delays, a.LoopCount)
+	if err == errAnimationTooBig {
+		return finishAnimation(c, id, "", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	return finishAnimation(c, id, outputData, "")
+}
+
+var errAnimationTooBig = errors.New("Dreamed frames are too big to put back together.")
+
+// Put the given images together into a GIF, and write it to storage.
+// Delays are how long each frame is shown for, in hundredths of a second;
+// frames without one are shown for a tenth of a second.
+// Returns errAnimationTooBig if the images have more pixels than we accept.
+func writeAnimation(c appengine.Context, filename string, frames []string,
+	delays []int, loopCount int) (gsPath string, err error) {
+
+	out := &gif.GIF{
+		LoopCount: loopCount,
+	}
+	pixels := 0
+	for i, frame := range frames {
+		img, err := readImage(c, frame)
+		if err != nil {
+			return "", err
+		}
+
+		// Dreams may come back bigger than the frames we sent.
+		pixels += img.Bounds().Dx() * img.Bounds().Dy()
+		if pixels > maxAnimationPixels {
+			return "", errAnimationTooBig
+		}
+
+		paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, img.Bounds(), img, img.Bounds().Min)
+		out.Image = append(out.Image, paletted)
+
+		delay := 10
+		if i < len(delays) {
+			delay = delays[i]
+		}
+		out.Delay = append(out.Delay, delay)
+	}
+
+	// Write the GIF as it's encoded, rather than holding it all as well.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(gif.EncodeAll(pw, out))
+	}()
+
+	gsPath, err = storage.WriteFileFrom(c, filename, "image/gif", pr)
+	pr.CloseWithError(err)
+	return gsPath, err
+}
+
+// Record that an animation has finished, with the given output,
+// or failed, with the given message.
+func finishAnimation(c appengine.Context, id, outputData, failureMessage string) error {
+
+	if failureMessage != "" {
+		c.Warningf("Animation %s failed: %s", id, failureMessage)
+	}
+
+	a := &Animation{ID: id}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, a.GetKey(c), a); err != nil {
+			return err
+		}
+		if a.Status == AnimationDone || a.Status == AnimationFailed {
+			return nil
+		}
+
+		if failureMessage != "" {
+			a.Status = AnimationFailed
+			a.FailureMessage = failureMessage
+		} else {
+			a.Status = AnimationDone
+			a.OutputData = outputData
+		}
+		a.FinishTime = time.Now()
+
+		_, err := datastore.Put(c, a.GetKey(c), a)
+		return err
+	}, nil)
+}
@@ -0,0 +1,506 @@
+package job
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/taskqueue"
+
+	"config"
+	"storage"
+)
+
+// Batches group many jobs submitted together.
+//
+// A batch's jobs start out queued, and are released for processing
+// a few at a time, so a big batch can't take every instance in the pool,
+// and jobs submitted on their own are still served promptly.
+// Whenever one of a batch's jobs finishes, we release more.
+// Jobs check the limit independently, so a batch may briefly run
+// a job or two more than it allows.
+
+var (
+	// The most images we accept in one batch.
+	MaxBatchJobs = config.GetInt("BATCH_MAX_JOBS", 100)
+
+	// The most jobs from one batch we process at once.
+	maxBatchConcurrentJobs = config.GetInt("BATCH_MAX_CONCURRENT_JOBS", 2)
+)
+
+// How long after a batch's job finishes we look for more to release.
+// This gives the datastore's indexes a moment to catch up,
+// so the finished job isn't still counted as running.
+const batchDispatchDelay = 5 * time.Second
+
+func init() {
+	http.HandleFunc("/job/cron/dispatch_batches", dispatchBatchesHandler)
+}
+
+// A group of jobs submitted together.
+type Batch struct {
+
+	// The unique ID of this batch.
+	ID string
+
+	// The time the batch was created.
+	CreateTime time.Time
+
+	// The user who created the batch. Empty if they weren't logged in.
+	User string
+
+	// The number of jobs in the batch.
+	Size int
+
+	// Whether the batch's jobs are the frames of the animation
+	// with the same ID as the batch.
+	Animation bool
+
+	// Whether each job's input is seeded with the previous job's output.
+	// The jobs are then processed one at a time.
+	SeedFromPrevious bool
+}
+
+func (b *Batch) GetKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Batch", b.ID, 0, nil)
+}
+
+// Create a batch with a job for each of the given inputs,
+// using the same options for every job.
+func CreateBatch(c appengine.Context, inputData []string, options Options) (id string, err error) {
+
+	if len(inputData) == 0 {
+		return "", &ValidationError{"No images in batch."}
+	}
+	if len(inputData) > MaxBatchJobs {
+		return "", &ValidationError{fmt.Sprintf(
+			"Too many images in batch; the most we accept is %d.", MaxBatchJobs)}
+	}
+
+	if err := options.applyPreset(c); err != nil {
+		return "", err
+	}
+
+	id, err = generateRandStr(64)
+	if err != nil {
+		return "", err
+	}
+
+	states, err := newBatchStates(id, inputData, options)
+	if err != nil {
+		return "", err
+	}
+
+	batch := &Batch{
+		ID:         id,
+		CreateTime: time.Now(),
+		User:       options.User,
+	}
+	if err := createBatch(c, batch, states, nil); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Returns the states of queued jobs for each of the given inputs of a batch.
+func newBatchStates(batchID string, inputData []string, options Options) (
+	states []*State, err error) {
+
+	states = make([]*State, len(inputData))
+	for i, input := range inputData {
+		state, err := newState(input, options)
+		if err != nil {
+			return nil, err
+		}
+
+		// A queued job's clock starts when it's released.
+		state.Status = StatusQueued
+		state.Deadline = time.Time{}
+		state.TimeoutTime = time.Time{}
+		state.BatchID = batchID
+		state.BatchIndex = i
+
+		states[i] = state
+	}
+
+	return states, nil
+}
+
+// Save a new batch and its queued jobs, and start dispatching them.
+// If given, also runs f in the transaction saving the batch.
+func createBatch(c appengine.Context, batch *Batch, states []*State,
+	f func(c appengine.Context) error) error {
+
+	keys := make([]*datastore.Key, len(states))
+	for i, state := range states {
+		keys[i] = state.GetKey(c)
+	}
+
+	// A batch's jobs span more entity groups than a transaction allows,
+	// so we save them first. Nothing releases them until the batch is
+	// saved, so if we fail before then, they just sit queued.
+	if _, err := datastore.PutMulti(c, keys, states); err != nil {
+		return err
+	}
+
+	batch.Size = len(states)
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, batch.GetKey(c), batch); err != nil {
+			return err
+		}
+
+		if f != nil {
+			if err := f(c); err != nil {
+				return err
+			}
+		}
+
+		dispatchBatchDelay.Call(c, batch.ID)
+		return nil
+	}, &datastore.TransactionOptions{
+		XG: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	jobsCreated.Add(c, int64(len(states)))
+	return nil
+}
+
+// Set up in init, since releasing a job can lead to releasing more.
+var dispatchBatchDelay *delay.Function
+
+func init() {
+	dispatchBatchDelay = delay.Func("dispatchBatch", dispatchBatch)
+}
+
+// Schedule releasing more of the batch's jobs, after the given job of it finished.
+// Must be run in a transaction.
+func (s *State) scheduleBatchDispatch(c appengine.Context) error {
+
+	t, err := dispatchBatchDelay.Task(s.BatchID)
+	if err != nil {
+		return err
+	}
+	t.Delay = batchDispatchDelay
+
+	_, err = taskqueue.Add(c, t, "")
+	return err
+}
+
+// Release as many of the batch's queued jobs for processing as its limit allows,
+// in the order they were submitted.
+func dispatchBatch(c appengine.Context, batchID string) error {
+
+	// Jobs of a batch which failed to be created have nothing to dispatch them.
+	batch := &Batch{ID: batchID}
+	if err := datastore.Get(c, batch.GetKey(c), batch); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			c.Warningf("Not dispatching jobs of missing batch %s.", batchID)
+			return nil
+		}
+		return err
+	}
+
+	// Jobs waiting for an instance were added after the final statuses,
+	// so sort after them, and have to be counted separately.
+	running, err := datastore.NewQuery("Job").
+		Filter("BatchID =", batchID).
+		Filter("Status <", int64(StatusDone)).
+		Count(c)
+	if err != nil {
+		return err
+	}
+	waiting, err := datastore.NewQuery("Job").
+		Filter("BatchID =", batchID).
+		Filter("Status =", int64(StatusWaitingForInstance)).
+		KeysOnly().
+		Count(c)
+	if err != nil {
+		return err
+	}
+	running += waiting
+
+	limit := maxBatchConcurrentJobs
+	if batch.SeedFromPrevious {
+		limit = 1
+	}
+
+	free := limit - running
+	if free <= 0 {
+		return nil
+	}
+
+	keys, err := datastore.NewQuery("Job").
+		Filter("BatchID =", batchID).
+		Filter("Status =", int64(StatusQueued)).
+		Order("BatchIndex").
+		Limit(free).
+		KeysOnly().
+		GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+
+	// Once every job has finished, an animation can be put together.
+	if running == 0 && len(keys) == 0 {
+		if batch.Animation {
+			return assembleAnimation(c, batchID)
+		}
+		return nil
+	}
+
+	for _, key := range keys {
+		s := &State{ID: key.StringID()}
+		c := withLogFields(c, &logFields{JobID: s.ID})
+
+		var inputData string
+		if batch.SeedFromPrevious {
+			if err := datastore.Get(c, s.GetKey(c), s); err != nil {
+				return err
+			}
+			if inputData, err = seedFromPrevious(c, s); err != nil {
+				return err
+			}
+		}
+
+		err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			return s.release(c, inputData)
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Release a queued job for processing, if it's still queued,
+// replacing its input if given one.
+// Must be run in a transaction.
+func (s *State) release(c appengine.Context, inputData string) error {
+
+	if err := datastore.Get(c, s.GetKey(c), s); err != nil {
+		return err
+	}
+	if s.Status != StatusQueued {
+		return nil
+	}
+
+	var putKeys []*datastore.Key
+	var putData []interface{}
+
+	if inputData != "" {
+		s.InputData = inputData
+	}
+	s.Deadline = time.Now().Add(jobTimeout)
+	s.changeStatus(StatusNew, c, &putKeys, &putData)
+
+	putKeys = append(putKeys, s.GetKey(c))
+	putData = append(putData, s)
+
+	if _, err := datastore.PutMulti(c, putKeys, putData); err != nil {
+		return err
+	}
+
+	return scheduleProcessJob(c, s.ID, 0)
+}
+
+func dispatchBatchesHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+	if err := DispatchBatches(c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Release jobs from every batch with jobs still queued,
+// and assemble any animations whose frames have all finished.
+// Batches are normally dispatched as their jobs finish,
+// so this only catches up on any which were missed.
+func DispatchBatches(c appengine.Context) error {
+
+	var queued []State
+	_, err := datastore.NewQuery("Job").
+		Filter("Status =", int64(StatusQueued)).
+		Project("BatchID").
+		Distinct().
+		GetAll(c, &queued)
+	if err != nil {
+		return err
+	}
+
+	batchIDs := make([]string, len(queued))
+	for i, s := range queued {
+		batchIDs[i] = s.BatchID
+	}
+
+	animationKeys, err := datastore.NewQuery("Animation").
+		Filter("Status =", int64(AnimationDreaming)).
+		KeysOnly().
+		GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	for _, key := range animationKeys {
+		batchIDs = append(batchIDs, key.StringID())
+	}
+
+	// If we fail to dispatch a batch, we'll try again next time we run.
+	for _, id := range batchIDs {
+		if err := dispatchBatch(c, id); err != nil {
+			c.Errorf("Failed to dispatch batch %s: %s", id, err)
+		}
+	}
+
+	return nil
+}
+
+// Returns the batch's jobs, in the order they were submitted.
+func (b *Batch) Jobs(c appengine.Context) (jobs []*State, err error) {
+	_, err = datastore.NewQuery("Job").
+		Filter("BatchID =", b.ID).
+		Order("BatchIndex").
+		GetAll(c, &jobs)
+	return jobs, err
+}
+
+// The overall status of a batch.
+type BatchStatus int
+
+const (
+	BatchRunning BatchStatus = iota
+	BatchDone
+	BatchPartlyFailed
+	BatchFailed
+)
+
+func (status BatchStatus) Description() string {
+	switch status {
+	case BatchRunning:
+		return "Dreaming..."
+	case BatchDone:
+		return "Finished."
+	case BatchPartlyFailed:
+		return "Finished, but some images failed."
+	case BatchFailed:
+		return "Failed to process any images."
+	}
+
+	return "Status is unknown."
+}
+
+func (status BatchStatus) String() string {
+	switch status {
+	case BatchRunning:
+		return "running"
+	case BatchDone:
+		return "done"
+	case BatchPartlyFailed:
+		return "partly_failed"
+	case BatchFailed:
+		return "failed"
+	}
+
+	return "unknown"
+}
+
+// How far a batch's jobs have got.
+type BatchProgress struct {
+	Total   int
+	Queued  int
+	Running int
+	Done    int
+	Failed  int
+}
+
+// Count how far the given jobs of a batch have got.
+func NewBatchProgress(jobs []*State) BatchProgress {
+
+	p := BatchProgress{Total: len(jobs)}
+	for _, s := range jobs {
+		switch {
+		case s.Status == StatusQueued:
+			p.Queued++
+		case s.Status == StatusDone:
+			p.Done++
+		case s.Status.Failed():
+			p.Failed++
+		default:
+			p.Running++
+		}
+	}
+
+	return p
+}
+
+func (p BatchProgress) Status() BatchStatus {
+	switch {
+	case p.Queued > 0 || p.Running > 0:
+		return BatchRunning
+	case p.Failed == 0:
+		return BatchDone
+	case p.Done == 0:
+		return BatchFailed
+	}
+
+	return BatchPartlyFailed
+}
+
+// Write a zip file of the outputs of the given jobs of a batch.
+// Jobs which haven't finished successfully are left out.
+func WriteBatchOutputs(c appengine.Context, w io.Writer, jobs []*State) error {
+
+	z := zip.NewWriter(w)
+	for _, s := range jobs {
+		if s.Status != StatusDone {
+			continue
+		}
+
+		if err := writeBatchOutput(c, z, s); err != nil {
+			return err
+		}
+	}
+
+	return z.Close()
+}
+
+// Copy a job's output into the zip file as it's read,
+// so we never hold more than a little of any output in memory.
+func writeBatchOutput(c appengine.Context, z *zip.Writer, s *State) error {
+
+	rc, err := storage.OpenFile(c, s.OutputData)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// Images are already compressed, so don't bother again.
+	f, err := z.CreateHeader(&zip.FileHeader{
+		Name:   batchOutputName(s),
+		Method: zip.Store,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, rc)
+	return err
+}
+
+// Returns the name of a job's output within its batch's zip file.
+func batchOutputName(s *State) string {
+	return fmt.Sprintf("dream-%03d.png", s.BatchNumber())
+}
+
+// Returns the job's position in its batch, counting from one, for display.
+func (s *State) BatchNumber() int {
+	return s.BatchIndex + 1
+}
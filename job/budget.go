@@ -0,0 +1,149 @@
+package job
+
+import (
+	"fmt"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+	"appengine/memcache"
+
+	"config"
+)
+
+// Limits on how much we'll spend on instances.
+// When any limit is reached, we stop launching instances,
+// and new jobs wait for instances to come free in the pool.
+// Zero means no limit.
+//
+// Jobs check the limits independently, so a burst of jobs
+// may overshoot them by a few instances.
+var (
+	hourlySpendLimit       = config.GetFloat("BUDGET_HOURLY_SPEND", 0)
+	dailySpendLimit        = config.GetFloat("BUDGET_DAILY_SPEND", 0)
+	maxConcurrentInstances = config.GetInt("MAX_CONCURRENT_INSTANCES", 0)
+)
+
+const (
+	// How often jobs waiting for an instance look at the pool again.
+	instanceWaitInterval = 30 * time.Second
+
+	// How often we'll email admins about hitting a limit.
+	budgetAlertInterval = time.Hour
+)
+
+// Returns whether we may launch another instance without exceeding our limits.
+// If not, alerts admins.
+func launchAllowed(c appengine.Context) (allowed bool, err error) {
+
+	if hourlySpendLimit == 0 && dailySpendLimit == 0 && maxConcurrentInstances == 0 {
+		return true, nil
+	}
+
+	now := time.Now()
+	hourlySpend, dailySpend, running, err := instanceSpend(c, now)
+	if err != nil {
+		return false, err
+	}
+
+	var reason string
+	switch {
+	case maxConcurrentInstances != 0 && running >= maxConcurrentInstances:
+		reason = fmt.Sprintf("%d instances are running, the most we allow.", running)
+	case hourlySpendLimit != 0 && hourlySpend >= hourlySpendLimit:
+		reason = fmt.Sprintf("$%.2f was spent on instances in the last hour, over our limit of $%.2f.",
+			hourlySpend, hourlySpendLimit)
+	case dailySpendLimit != 0 && dailySpend >= dailySpendLimit:
+		reason = fmt.Sprintf("$%.2f was spent on instances in the last day, over our limit of $%.2f.",
+			dailySpend, dailySpendLimit)
+	default:
+		return true, nil
+	}
+
+	alertBudgetReached(c, reason)
+	return false, nil
+}
+
+// Returns what we've spent on instances in the hour and day before now,
+// and how many instances are running.
+func instanceSpend(c appengine.Context, now time.Time) (
+	hourlySpend, dailySpend float64, running int, err error) {
+
+	hourStart := now.Add(-time.Hour)
+	dayStart := now.Add(-24 * time.Hour)
+
+	// Instances are settled when terminated,
+	// so unsettled instances are still running.
+	var live []InstanceUsage
+	_, err = datastore.NewQuery("InstanceUsage").
+		Filter("Settled =", false).
+		GetAll(c, &live)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var terminated []InstanceUsage
+	_, err = datastore.NewQuery("InstanceUsage").
+		Filter("TerminateTime >=", dayStart).
+		GetAll(c, &terminated)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	for _, usage := range append(live, terminated...) {
+		end := usage.TerminateTime
+		if end.IsZero() {
+			end = now
+		}
+
+		price := pricePerSecond(usage.Type)
+		hourlySpend += overlapSeconds(usage.LaunchTime, end, hourStart, now) * price
+		dailySpend += overlapSeconds(usage.LaunchTime, end, dayStart, now) * price
+	}
+
+	return hourlySpend, dailySpend, len(live), nil
+}
+
+// Returns how many seconds two periods of time have in common.
+func overlapSeconds(aStart, aEnd, bStart, bEnd time.Time) float64 {
+	if aStart.Before(bStart) {
+		aStart = bStart
+	}
+	if aEnd.After(bEnd) {
+		aEnd = bEnd
+	}
+	if !aEnd.After(aStart) {
+		return 0
+	}
+	return aEnd.Sub(aStart).Seconds()
+}
+
+// Email admins that a budget limit has stopped us launching instances,
+// unless we've already done so recently.
+func alertBudgetReached(c appengine.Context, reason string) {
+
+	c.Warningf("Not launching instance: " + reason)
+
+	// Adding fails if the item already exists,
+	// so only one alert gets through each interval.
+	err := memcache.Add(c, &memcache.Item{
+		Key:        "budget_alert_sent",
+		Value:      []byte(reason),
+		Expiration: budgetAlertInterval,
+	})
+	if err != nil {
+		return
+	}
+
+	msg := &mail.Message{
+		Sender:  mailSender(c),
+		Subject: "Dreampics has stopped launching dream servers",
+		Body: "New jobs are waiting for free dream servers instead of launching new ones, because:\n\n" +
+			reason + "\n\n" +
+			"Limits can be changed in config.json.\n",
+	}
+	if err := mailer.SendToAdmins(c, msg); err != nil {
+		c.Errorf("Failed to send budget alert: " + err.Error())
+	}
+}
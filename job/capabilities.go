@@ -0,0 +1,158 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"appengine"
+)
+
+// Dream servers describe what they can do in a capabilities document,
+// which we fetch when checking a new instance is up, and again at each
+// health check while it's in the pool, keeping the latest with the instance.
+// Jobs are only given instances whose capabilities meet their needs.
+//
+//	GET /capabilities?auth_code=...
+//		Responds with {"version": 2, "params": ["octaves", ...],
+//		"guide": true, "max_image_bytes": 20971520, "concurrency": 1}.
+//
+// Dream servers predating this have no such document,
+// and are taken to speak version 1 of the protocol.
+
+// The earliest version of the dream server protocol we can use.
+// Version 2 added running dreams asynchronously.
+const minDreamServerVersion = 2
+
+// What an instance's dream server can do.
+type Capabilities struct {
+
+	// The version of the protocol the dream server speaks.
+	// Zero if we haven't asked.
+	Version int `json:"version"`
+
+	// The dream parameters the dream server accepts.
+	Params []string `json:"params" datastore:",noindex"`
+
+	// Whether the dream server accepts guide images.
+	Guide bool `json:"guide" datastore:",noindex"`
+
+	// The largest image the dream server accepts, in bytes.
+	// Zero for no limit.
+	MaxImageBytes int64 `json:"max_image_bytes" datastore:",noindex"`
+
+	// How many dreams the dream server runs at once.
+	// Shown to admins only; we still give each instance one job at a time.
+	Concurrency int `json:"concurrency" datastore:",noindex"`
+}
+
+// Fetch the capabilities of the instance's dream server,
+// also returning the public IP we reached it at.
+func (i *Instance) getCapabilities(c appengine.Context) (caps Capabilities, ip string, err error) {
+
+	query := url.Values{}
+	query.Set("auth_code", i.AuthCode)
+
+	resp, err := i.get(c, "capabilities?"+query.Encode())
+	if err != nil {
+		return caps, "", err
+	}
+	defer resp.Body.Close()
+	ip = strings.Split(resp.Request.URL.Host, ":")[0]
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Capabilities{Version: 1}, ip, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return caps, "", dreamServerError("Fetching capabilities failed", resp)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+		return caps, "", err
+	}
+	if caps.Version < 1 {
+		return caps, "", errors.New("Dream server returned no protocol version.")
+	}
+
+	return caps, ip, nil
+}
+
+// What a job needs of a dream server.
+type dreamRequirements struct {
+
+	// The dream parameters the job uses.
+	Params []string
+
+	// Whether the job has a guide image.
+	Guide bool
+
+	// The size of the job's input, in bytes. Zero if unknown.
+	// Pipelines and zoom dreams may dream larger images later on,
+	// which can't be known in advance, so each dream is also checked
+	// against the instance's capabilities before it's submitted.
+	InputBytes int64
+}
+
+// Returns what the job needs of a dream server.
+func (s *State) requirements() (r dreamRequirements) {
+
+	params := map[string]bool{}
+	addParams := func(query string) {
+		values, _ := url.ParseQuery(query)
+		for name := range values {
+			params[name] = true
+		}
+	}
+	addParams(s.DreamParams)
+	for _, step := range s.Pipeline {
+		if step.Op == StepDream {
+			addParams(step.Params)
+		}
+	}
+
+	for name := range params {
+		r.Params = append(r.Params, name)
+	}
+	sort.Strings(r.Params)
+
+	r.Guide = s.GuideData != ""
+	r.InputBytes = s.InputBytes
+	return r
+}
+
+// Check the capabilities meet the given requirements,
+// returning an error saying why if they don't.
+func (caps *Capabilities) satisfy(r dreamRequirements) error {
+
+	if caps.Version < minDreamServerVersion {
+		return fmt.Errorf("dream server speaks protocol version %d, but we need at least %d",
+			caps.Version, minDreamServerVersion)
+	}
+	if r.Guide && !caps.Guide {
+		return errors.New("dream server doesn't accept guide images")
+	}
+	if caps.MaxImageBytes > 0 && r.InputBytes > caps.MaxImageBytes {
+		return fmt.Errorf("image is %d bytes, but the dream server accepts at most %d",
+			r.InputBytes, caps.MaxImageBytes)
+	}
+
+	supported := map[string]bool{}
+	for _, name := range caps.Params {
+		supported[name] = true
+	}
+	var missing []string
+	for _, name := range r.Params {
+		if !supported[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("dream server doesn't accept parameters: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,325 @@
+package job
+
+import (
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+
+	"config"
+)
+
+// Costs are worked out from instance time.
+//
+// A job is charged for the time it holds a running instance,
+// plus a share of the time the instance spent booting.
+// Boot time is shared equally between every job an instance served,
+// and is only settled once the instance is terminated,
+// when we know how many jobs that was.
+// Time instances spend idle in the pool isn't charged to any job,
+// but is recorded against the instance, so we can report it separately.
+
+// Records how an instance's time was spent.
+// Created when the instance is launched, and settled when it's terminated.
+type InstanceUsage struct {
+
+	// The EC2 instance type, which determines its price.
+	Type string
+
+	// The time we sent the launch request.
+	LaunchTime time.Time
+
+	// How long the instance took to start responding after launch.
+	// Zero if it never did.
+	BootSeconds float64
+
+	// The time the instance was terminated. Zero if it's still running.
+	TerminateTime time.Time
+
+	// How long the instance spent in the pool, unused by any job.
+	// Only known once the instance is settled.
+	IdleSeconds float64
+
+	// The cost of the instance's idle time.
+	IdleCost float64
+
+	// Whether the instance's boot time has been shared out among its jobs.
+	Settled bool
+}
+
+// Records one job's use of an instance.
+// Stored as a child entity of the instance's InstanceUsage,
+// keyed by the job's ID.
+type InstanceUse struct {
+
+	// How long the job held the instance while it was running.
+	BusySeconds float64
+}
+
+// Returns the price of running an instance of the given type for a second.
+// Prices are configured per hour, by keys of the form
+// INSTANCE_HOURLY_PRICE_g2.2xlarge.
+func pricePerSecond(instanceType string) float64 {
+	return config.GetFloat("INSTANCE_HOURLY_PRICE_"+instanceType, 0) / 3600
+}
+
+// Returns the instance's EC2 instance type.
+// Instances predating us recording it use our current type.
+func (i *Instance) instanceType() string {
+	if i.Type == "" {
+		return dreamServerInstanceType
+	}
+	return i.Type
+}
+
+func instanceUsageKey(c appengine.Context, instanceID string) *datastore.Key {
+	return datastore.NewKey(c, "InstanceUsage", instanceID, 0, nil)
+}
+
+// Start recording usage of the job's newly launched instance.
+// Must be run in a cross-group transaction.
+func (s *State) startInstanceUsage(c appengine.Context,
+	putKeys *[]*datastore.Key,
+	putData *[]interface{}) {
+
+	usage := &InstanceUsage{
+		Type:       s.Instance.instanceType(),
+		LaunchTime: s.Instance.LaunchTime,
+	}
+
+	*putKeys = append(*putKeys, instanceUsageKey(c, s.Instance.ID))
+	*putData = append(*putData, usage)
+}
+
+// Record that the job's instance has finished booting.
+// Must be run in a cross-group transaction.
+func (s *State) recordInstanceBooted(c appengine.Context,
+	putKeys *[]*datastore.Key,
+	putData *[]interface{}) error {
+
+	key := instanceUsageKey(c, s.Instance.ID)
+	usage := new(InstanceUsage)
+	if err := datastore.Get(c, key, usage); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+
+	usage.BootSeconds = time.Since(usage.LaunchTime).Seconds()
+
+	*putKeys = append(*putKeys, key)
+	*putData = append(*putData, usage)
+	return nil
+}
+
+// Charge the job for the time it's held its instance,
+// and let go of the instance, terminating it if requested.
+// Must be run in a transaction.
+func (s *State) releaseInstance(c appengine.Context, terminate bool) {
+
+	var busySeconds float64
+	if !s.InstanceAcquireTime.IsZero() {
+		busySeconds = time.Since(s.InstanceAcquireTime).Seconds()
+	}
+
+	s.InstanceSeconds += busySeconds
+	s.Cost += busySeconds * pricePerSecond(s.Instance.instanceType())
+	s.InstanceAcquireTime = time.Time{}
+
+	releaseInstanceDelay.Call(c, s.Instance.ID, s.ID, busySeconds, terminate)
+}
+
+var releaseInstanceDelay = delay.Func("releaseInstance", releaseInstance)
+
+// Record a job's use of an instance, then terminate the instance if requested.
+// These are done in the same task so the instance can't be settled
+// before we've recorded every job it served.
+func releaseInstance(c appengine.Context, instanceID, jobID string,
+	busySeconds float64, terminate bool) error {
+
+	c = withLogFields(c, &logFields{JobID: jobID, InstanceID: instanceID})
+	c.Infof("Job released instance after %.0f seconds.", busySeconds)
+
+	useKey := datastore.NewKey(c, "InstanceUse", jobID, 0, instanceUsageKey(c, instanceID))
+	if _, err := datastore.Put(c, useKey, &InstanceUse{busySeconds}); err != nil {
+		return err
+	}
+
+	if terminate {
+		return terminateInstance(c, instanceID)
+	}
+
+	return nil
+}
+
+// Share the boot time of a terminated instance out among the jobs it served,
+// and work out how long it sat idle.
+// Safe to run more than once.
+func settleInstanceUsage(c appengine.Context, instanceID string) error {
+
+	key := instanceUsageKey(c, instanceID)
+	usage := new(InstanceUsage)
+	if err := datastore.Get(c, key, usage); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+	if usage.Settled {
+		return nil
+	}
+
+	var uses []InstanceUse
+	useKeys, err := datastore.NewQuery("InstanceUse").Ancestor(key).GetAll(c, &uses)
+	if err != nil {
+		return err
+	}
+
+	if usage.TerminateTime.IsZero() {
+		usage.TerminateTime = time.Now()
+	}
+	lifetime := usage.TerminateTime.Sub(usage.LaunchTime).Seconds()
+
+	var busySeconds float64
+	for _, use := range uses {
+		busySeconds += use.BusySeconds
+	}
+
+	// An instance which never responded spent its whole life booting.
+	if usage.BootSeconds == 0 {
+		usage.BootSeconds = lifetime - busySeconds
+	}
+
+	usage.IdleSeconds = lifetime - usage.BootSeconds - busySeconds
+	if usage.IdleSeconds < 0 {
+		usage.IdleSeconds = 0
+	}
+	price := pricePerSecond(usage.Type)
+	usage.IdleCost = usage.IdleSeconds * price
+
+	if len(uses) > 0 {
+		share := usage.BootSeconds / float64(len(uses))
+		for _, useKey := range useKeys {
+			if err := chargeOverhead(c, useKey.StringID(), instanceID, share, price); err != nil {
+				return err
+			}
+		}
+	} else {
+		// Nobody to share the boot time with, so count it as idle.
+		usage.IdleSeconds += usage.BootSeconds
+		usage.IdleCost = usage.IdleSeconds * price
+	}
+
+	usage.Settled = true
+	_, err = datastore.Put(c, key, usage)
+	return err
+}
+
+// Charge a job its share of an instance's boot time.
+// Does nothing if the job has already been charged for this instance.
+func chargeOverhead(c appengine.Context, jobID, instanceID string,
+	seconds, pricePerSecond float64) error {
+
+	s := &State{ID: jobID}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, s.GetKey(c), s); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+
+		for _, id := range s.OverheadInstances {
+			if id == instanceID {
+				return nil
+			}
+		}
+
+		s.OverheadSeconds += seconds
+		s.Cost += seconds * pricePerSecond
+		s.OverheadInstances = append(s.OverheadInstances, instanceID)
+
+		_, err := datastore.Put(c, s.GetKey(c), s)
+		return err
+	}, nil)
+}
+
+// The costs of a group of jobs.
+type JobCosts struct {
+	Jobs            int
+	InstanceSeconds float64
+	OverheadSeconds float64
+	Cost            float64
+}
+
+func (j *JobCosts) add(s *State) {
+	j.Jobs++
+	j.InstanceSeconds += s.InstanceSeconds
+	j.OverheadSeconds += s.OverheadSeconds
+	j.Cost += s.Cost
+}
+
+// The costs incurred on one day.
+type CostReport struct {
+	Day time.Time
+
+	// The costs of jobs created on the day, by the user who created them.
+	// Jobs created without a user are under the empty string.
+	Users map[string]*JobCosts
+
+	// The costs of all jobs created on the day.
+	Total JobCosts
+
+	// Time instances terminated on the day spent idle, and what it cost.
+	IdleSeconds float64
+	IdleCost    float64
+}
+
+// Build a report of the costs incurred on the day containing the given time,
+// in UTC. Costs of jobs may still rise after the day ends,
+// until the instances they used are terminated.
+func DailyCostReport(c appengine.Context, day time.Time) (report *CostReport, err error) {
+
+	start := day.UTC().Truncate(24 * time.Hour)
+	end := start.Add(24 * time.Hour)
+
+	report = &CostReport{
+		Day:   start,
+		Users: make(map[string]*JobCosts),
+	}
+
+	var jobs []*State
+	_, err = datastore.NewQuery("Job").
+		Filter("CreateTime >=", start).
+		Filter("CreateTime <", end).
+		GetAll(c, &jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range jobs {
+		if report.Users[s.User] == nil {
+			report.Users[s.User] = new(JobCosts)
+		}
+		report.Users[s.User].add(s)
+		report.Total.add(s)
+	}
+
+	var usages []InstanceUsage
+	_, err = datastore.NewQuery("InstanceUsage").
+		Filter("TerminateTime >=", start).
+		Filter("TerminateTime <", end).
+		GetAll(c, &usages)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, usage := range usages {
+		report.IdleSeconds += usage.IdleSeconds
+		report.IdleCost += usage.IdleCost
+	}
+
+	return report, nil
+}
@@ -0,0 +1,80 @@
+package job
+
+import (
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+func init() {
+	http.HandleFunc("/job/cron/check_deadlines", checkDeadlinesHandler)
+}
+
+func checkDeadlinesHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+	if err := CheckDeadlines(c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Time out every job which has overrun its deadline,
+// cleaning up any instance it holds.
+func CheckDeadlines(c appengine.Context) error {
+
+	// Finished jobs have a zero timeout time, so we exclude them by
+	// filtering for timeout times after the epoch. Jobs from before we
+	// had deadlines lack the property entirely, so are also excluded.
+	now := time.Now()
+	q := datastore.NewQuery("Job").
+		Filter("TimeoutTime >", time.Unix(0, 0)).
+		Filter("TimeoutTime <", now).
+		KeysOnly()
+
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+
+	// If we fail to time out a given job,
+	// we'll try again next time we run.
+	for _, key := range keys {
+		state := &State{ID: key.StringID()}
+		c := withLogFields(c, &logFields{JobID: state.ID})
+		err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+			return state.timeOut(c, now)
+		}, nil)
+		if err != nil {
+			c.Errorf("Failed to time out job: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Move the job to StatusTimedOut if it's still overdue at the given time.
+// Must be run in a transaction.
+func (s *State) timeOut(c appengine.Context, now time.Time) error {
+
+	if err := datastore.Get(c, s.GetKey(c), s); err != nil {
+		return err
+	}
+
+	if s.TimeoutTime.IsZero() || s.TimeoutTime.After(now) {
+		return nil
+	}
+
+	var putKeys []*datastore.Key
+	var putData []interface{}
+
+	message := "Deadline passed at " + s.TimeoutTime.Format(time.RFC3339) + "."
+	s.fail(StatusTimedOut, CauseTimedOut, message, c, &putKeys, &putData)
+
+	putKeys = append(putKeys, s.GetKey(c))
+	putData = append(putData, s)
+
+	_, err := datastore.PutMulti(c, putKeys, putData)
+	return err
+}
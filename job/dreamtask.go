@@ -0,0 +1,333 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"appengine"
+
+	"config"
+	"storage"
+)
+
+// Dreams are run on the dream server asynchronously. We submit the
+// image, getting back the ID of a task on the dream server, which we
+// save with the job. Later runs of processJob then poll the task,
+// coming back again after a while until it's done, and then fetch
+// its result. So if a connection drops or we're restarted part way
+// through a dream, we pick up where we left off, rather than
+// dreaming from scratch.
+//
+// The dream server's API for this:
+//
+//	POST /dream/submit?auth_code=...&<dream params>
+//		multipart "image" and optional "guide" files.
+//		Responds with {"task_id": "..."}.
+//	GET /dream/task/{id}?auth_code=...
+//		Responds with {"status": "running"|"done"|"failed", "error": "..."},
+//		or 404 if the dream server has no such task.
+//		Running tasks may also report their progress, with
+//		"octave" and "iteration", the octave being dreamed and the
+//		iterations of it done, counting from one, out of "octaves" and
+//		"iterations"; "progress", the fraction of the dream done;
+//		and "eta_seconds", how much longer the dream should take.
+//	GET /dream/task/{id}/result?auth_code=...
+//		Responds with the dreamed image, once done.
+
+var (
+	// How long we wait between polls of a running dream.
+	dreamPollInterval = config.GetDuration("DREAM_POLL_INTERVAL", 15*time.Second)
+)
+
+// The most of an error response from the dream server we record.
+const dreamServerMaxErrorLength = 1024
+
+// The state of a dream task on the dream server.
+type dreamTaskStatus struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error"`
+	Octave     int     `json:"octave"`
+	Octaves    int     `json:"octaves"`
+	Iteration  int     `json:"iteration"`
+	Iterations int     `json:"iterations"`
+	Progress   float64 `json:"progress"`
+	ETASeconds float64 `json:"eta_seconds"`
+}
+
+// How far a running dream has got, as last reported by the dream server.
+// Anything the dream server didn't report is zero.
+type DreamProgress struct {
+
+	// The octave being dreamed, counting from one, and how many there are.
+	Octave  int `datastore:",noindex"`
+	Octaves int `datastore:",noindex"`
+
+	// The iterations of the current octave done, and how many there are.
+	Iteration  int `datastore:",noindex"`
+	Iterations int `datastore:",noindex"`
+
+	// The fraction of the dream done, from zero to one.
+	Fraction float64 `datastore:",noindex"`
+
+	// When the dream server expects the dream to finish.
+	ETA time.Time `datastore:",noindex"`
+
+	// When the dream server last reported progress. Zero if it hasn't.
+	UpdateTime time.Time `datastore:",noindex"`
+}
+
+// Returns progress as reported in a dream task's status.
+func newDreamProgress(status *dreamTaskStatus) DreamProgress {
+
+	now := time.Now()
+	p := DreamProgress{
+		Octave:     status.Octave,
+		Octaves:    status.Octaves,
+		Iteration:  status.Iteration,
+		Iterations: status.Iterations,
+		Fraction:   status.Progress,
+		UpdateTime: now,
+	}
+
+	// If not told how far it's got overall, work it out from the octaves.
+	if p.Fraction == 0 && p.Octaves > 0 && p.Iterations > 0 && p.Octave > 0 {
+		done := (p.Octave-1)*p.Iterations + p.Iteration
+		p.Fraction = float64(done) / float64(p.Octaves*p.Iterations)
+	}
+	if p.Fraction > 1 {
+		p.Fraction = 1
+	}
+
+	if status.ETASeconds > 0 {
+		p.ETA = now.Add(time.Duration(status.ETASeconds * float64(time.Second)))
+	}
+
+	return p
+}
+
+// Returns whether any progress has been reported.
+func (p DreamProgress) Known() bool {
+	return !p.UpdateTime.IsZero()
+}
+
+// Returns how much of the dream is done, as a whole percentage.
+func (p DreamProgress) Percent() int {
+	return int(p.Fraction * 100)
+}
+
+// Returns how much longer the dream should take, to the second.
+// Zero if unknown, or overdue.
+func (p DreamProgress) Remaining() time.Duration {
+	if p.ETA.IsZero() {
+		return 0
+	}
+
+	remaining := p.ETA.Sub(time.Now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining - remaining%time.Second
+}
+
+func (p DreamProgress) Description() string {
+	if !p.Known() {
+		return "Dream has started."
+	}
+
+	description := fmt.Sprintf("%d%% dreamed", p.Percent())
+	if p.Octaves > 0 {
+		description += fmt.Sprintf(", octave %d of %d", p.Octave, p.Octaves)
+	}
+	if p.Iterations > 0 {
+		description += fmt.Sprintf(", iteration %d of %d", p.Iteration, p.Iterations)
+	}
+	if remaining := p.Remaining(); remaining > 0 {
+		description += fmt.Sprintf(", about %s left", remaining)
+	}
+
+	return description + "."
+}
+
+// Returns whether the job has a dream running on the dream server,
+// whose progress can be shown.
+func (s *State) DreamRunning() bool {
+	return s.Status == StatusHaveInstance && s.DreamTaskID != ""
+}
+
+// An error in the dream itself, rather than in talking to the dream server.
+// The dream is submitted again when retried, rather than polled again.
+type dreamTaskError struct {
+	message string
+}
+
+func (e *dreamTaskError) Error() string {
+	return e.message
+}
+
+// Returns the cloud storage object to send for the next dream.
+func (s *State) dreamInput() string {
+	if len(s.Pipeline) > 0 && len(s.StepOutputs) > 0 {
+		return s.StepOutputs[len(s.StepOutputs)-1]
+	}
+	if s.ZoomInput != "" {
+		return s.ZoomInput
+	}
+	return s.InputData
+}
+
+// Returns the parameters for the next dream, beyond the job's own.
+func (s *State) dreamParams() (url.Values, error) {
+	if len(s.Pipeline) > 0 {
+		return url.ParseQuery(s.Pipeline[len(s.StepOutputs)].Params)
+	}
+	return url.Values{}, nil
+}
+
+// Returns the name to store the output of the current dream under.
+func (s *State) dreamOutputName() string {
+	switch {
+	case len(s.Pipeline) > 0:
+		return stepOutputName(s, len(s.StepOutputs))
+	case s.zooming():
+		return fmt.Sprintf("job/%s/zoom-%03d", s.ID, len(s.ZoomFrames))
+	}
+	return "job/" + s.ID + "/output"
+}
+
+// Returns the query to send with requests to the job's instance,
+// with the given parameters, and the instance's auth code.
+func (s *State) dreamServerQuery(params url.Values) string {
+	query := url.Values{}
+	for name, values := range params {
+		query[name] = values
+	}
+	query.Set("auth_code", s.Instance.AuthCode)
+	return query.Encode()
+}
+
+// Submit the job's next dream to its instance, returning the ID
+// of the dream server's task for it.
+// If the image is too big for the instance, returns a *taskFailure.
+func (s *State) submitDream(c appengine.Context) (taskID string, err error) {
+
+	// Earlier steps or passes may have made the image bigger than the
+	// job's input, which is all the instance was matched against.
+	if maxBytes := s.Instance.Capabilities.MaxImageBytes; maxBytes > 0 {
+		size, err := storage.FileSize(c, s.dreamInput())
+		if err != nil {
+			return "", err
+		}
+		if size > maxBytes {
+			return "", &taskFailure{CauseUnsupported, fmt.Sprintf(
+				"No dream server can run this job: image to dream is %d bytes, "+
+					"but the dream server accepts at most %d.", size, maxBytes)}
+		}
+	}
+
+	files := []formFile{{"image", s.dreamInput()}}
+
+	// Guided dreams steer the dream's features towards those of the guide image.
+	if s.GuideData != "" {
+		files = append(files, formFile{"guide", s.GuideData})
+	}
+
+	// Parameters given for this dream override the job's own.
+	params, err := url.ParseQuery(s.DreamParams)
+	if err != nil {
+		return "", err
+	}
+	stepParams, err := s.dreamParams()
+	if err != nil {
+		return "", err
+	}
+	for name, values := range stepParams {
+		params[name] = values
+	}
+
+	resp, err := s.Instance.postFile(c, "dream/submit?"+s.dreamServerQuery(params), files...)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return "", dreamServerError("Submitting dream failed", resp)
+	}
+
+	var result struct {
+		TaskID string `json:"task_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.TaskID == "" {
+		return "", errors.New("Dream server returned no task ID.")
+	}
+
+	return result.TaskID, nil
+}
+
+// Check on the job's running dream, returning whether it's done,
+// and if it's still running, how far it's got.
+// If the dream failed, or the dream server lost it, returns a *dreamTaskError.
+func (s *State) pollDream(c appengine.Context) (done bool, progress DreamProgress, err error) {
+
+	resp, err := s.Instance.get(c, "dream/task/"+url.QueryEscape(s.DreamTaskID)+
+		"?"+s.dreamServerQuery(nil))
+	if err != nil {
+		return false, progress, err
+	}
+	defer resp.Body.Close()
+
+	// Instances forget their tasks if restarted.
+	if resp.StatusCode == http.StatusNotFound {
+		return false, progress, &dreamTaskError{"Dream server has no record of the dream."}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, progress, dreamServerError("Polling dream failed", resp)
+	}
+
+	var status dreamTaskStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return false, progress, err
+	}
+
+	switch status.Status {
+	case "running":
+		return false, newDreamProgress(&status), nil
+	case "done":
+		return true, progress, nil
+	case "failed":
+		return false, progress, &dreamTaskError{"Dream failed: " + status.Error}
+	}
+
+	return false, progress, fmt.Errorf("Dream server returned unknown status %q.", status.Status)
+}
+
+// Fetch the result of the job's finished dream, storing it as it arrives.
+// Returns its cloud storage object.
+func (s *State) fetchDream(c appengine.Context) (outputData string, err error) {
+
+	resp, err := s.Instance.get(c, "dream/task/"+url.QueryEscape(s.DreamTaskID)+
+		"/result?"+s.dreamServerQuery(nil))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", dreamServerError("Fetching dream failed", resp)
+	}
+
+	return storage.WriteFileFrom(c, s.dreamOutputName(), "image/png", resp.Body)
+}
+
+// Returns an error describing an unsuccessful response from the dream server.
+func dreamServerError(what string, resp *http.Response) error {
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, dreamServerMaxErrorLength))
+	return fmt.Errorf("%s: %s: %s", what, resp.Status, message)
+}
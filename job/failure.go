@@ -0,0 +1,194 @@
+package job
+
+import (
+	"errors"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// The reason a job ended up in a failed status.
+type FailureCause string
+
+const (
+	CauseNone FailureCause = ""
+
+	// The job went through its limit of instances,
+	// each of which we gave up on as dead.
+	CauseInstancesExhausted FailureCause = "instances_exhausted"
+
+	// A task failed more times than its retry policy allows.
+	CauseRetriesExhausted FailureCause = "retries_exhausted"
+
+	// The job overran its deadline or its current stage's time limit.
+	CauseTimedOut FailureCause = "timed_out"
+
+	// An admin failed the job by hand.
+	CauseAdmin FailureCause = "admin"
+
+	// None of our dream servers can do what the job needs.
+	CauseUnsupported FailureCause = "unsupported"
+
+	// A pipeline step would have made an image bigger than we allow.
+	CauseImageTooBig FailureCause = "image_too_big"
+)
+
+// All failure causes, in the order we list them to admins.
+var FailureCauses = []FailureCause{
+	CauseInstancesExhausted,
+	CauseRetriesExhausted,
+	CauseTimedOut,
+	CauseAdmin,
+	CauseUnsupported,
+	CauseImageTooBig,
+}
+
+func (cause FailureCause) Description() string {
+	switch cause {
+	case CauseNone:
+		return "None."
+	case CauseInstancesExhausted:
+		return "Ran out of dream servers to try."
+	case CauseRetriesExhausted:
+		return "Ran out of retries."
+	case CauseTimedOut:
+		return "Timed out."
+	case CauseAdmin:
+		return "Failed by an admin."
+	case CauseUnsupported:
+		return "No dream server can run the job."
+	case CauseImageTooBig:
+		return "Image grew too big."
+	}
+
+	return "Cause is unknown."
+}
+
+// An error in a task which retrying won't help,
+// so fails the job straight away with the given cause.
+type taskFailure struct {
+	cause   FailureCause
+	message string
+}
+
+func (e *taskFailure) Error() string {
+	return e.message
+}
+
+// Move the job to the given failed status, recording why,
+// and terminating any instance it still holds.
+func (s *State) fail(newStatus Status,
+	cause FailureCause,
+	message string,
+	c appengine.Context,
+	putKeys *[]*datastore.Key,
+	putData *[]interface{}) {
+
+	c.Infof("Job failed with cause %s: %s", cause, message)
+
+	if s.Instance.ID != "" {
+		s.releaseInstance(c, true)
+		s.Instance = Instance{}
+	}
+
+	s.FailureCause = cause
+	s.FailureStage = s.Status
+	s.FailureMessage = message
+	s.FailureAttempts = s.TotalTaskFailures
+	s.FailureTime = time.Now()
+
+	s.changeStatus(newStatus, c, putKeys, putData)
+}
+
+// Fail a job which is still being processed, at an admin's request.
+func Fail(c appengine.Context, id string) error {
+
+	s := &State{ID: id}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, s.GetKey(c), s); err != nil {
+			return err
+		}
+
+		if s.Status.Final() {
+			return errors.New("Job has already finished.")
+		}
+
+		var putKeys []*datastore.Key
+		var putData []interface{}
+
+		s.fail(StatusFailed, CauseAdmin, "Failed by an admin.", c, &putKeys, &putData)
+
+		putKeys = append(putKeys, s.GetKey(c))
+		putData = append(putData, s)
+
+		_, err := datastore.PutMulti(c, putKeys, putData)
+		return err
+	}, nil)
+}
+
+// Returns the most recently failed jobs, newest first.
+// If cause is not CauseNone, only jobs which failed for that cause are returned.
+func FailedJobs(c appengine.Context, cause FailureCause, limit int) (
+	jobs []*State, err error) {
+
+	// Jobs which haven't failed have a zero failure time,
+	// so filtering for failure times after the epoch excludes them.
+	q := datastore.NewQuery("Job")
+	if cause != CauseNone {
+		q = q.Filter("FailureCause =", string(cause))
+	} else {
+		q = q.Filter("FailureTime >", time.Unix(0, 0))
+	}
+	q = q.Order("-FailureTime").Limit(limit)
+
+	_, err = q.GetAll(c, &jobs)
+	return jobs, err
+}
+
+// Reset a failed job to StatusNew, reusing its input,
+// and schedule it to be processed again.
+func Replay(c appengine.Context, id string) error {
+
+	s := &State{ID: id}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, s.GetKey(c), s); err != nil {
+			return err
+		}
+
+		if !s.Status.Failed() {
+			return errors.New("Job has not failed.")
+		}
+
+		var putKeys []*datastore.Key
+		var putData []interface{}
+
+		s.Deadline = time.Now().Add(jobTimeout)
+		s.OutputData = ""
+		s.DreamFinishTime = time.Time{}
+		s.ZoomFrames = nil
+		s.ZoomInput = ""
+		s.DreamTaskID = ""
+		s.DreamFailures = 0
+		s.StepOutputs = nil
+		s.Instance = Instance{}
+		s.LaunchToken = ""
+		s.InstancesDiscarded = 0
+		s.FailureCause = CauseNone
+		s.FailureStage = StatusNew
+		s.FailureMessage = ""
+		s.FailureAttempts = 0
+		s.FailureTime = time.Time{}
+		s.Replays++
+		s.changeStatus(StatusNew, c, &putKeys, &putData)
+
+		putKeys = append(putKeys, s.GetKey(c))
+		putData = append(putData, s)
+
+		if _, err := datastore.PutMulti(c, putKeys, putData); err != nil {
+			return err
+		}
+
+		return scheduleProcessJob(c, s.ID, 0)
+	}, nil)
+}
@@ -0,0 +1,171 @@
+package job
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+)
+
+const (
+	// How long we wait for an idle instance to answer a health check.
+	healthCheckTimeout = 20 * time.Second
+
+	// How many times we try to reach an instance before declaring it dead.
+	healthCheckAttempts = 2
+
+	// How long an idle pool instance may go without being seen healthy
+	// before we stop handing it out to jobs.
+	// This allows for a couple of missed health check runs.
+	poolHealthMaxAge = 12 * time.Minute
+)
+
+func init() {
+	http.HandleFunc("/job/cron/check_pool", checkPoolHandler)
+}
+
+func checkPoolHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+	if err := CheckPool(c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Schedule a health check of every instance currently in the pool.
+// The checks themselves run as separate tasks, so one slow instance
+// doesn't hold up checking the rest.
+func CheckPool(c appengine.Context) error {
+
+	q := datastore.NewQuery("PoolInstance").KeysOnly()
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		checkPoolInstanceDelay.Call(c, key.StringID())
+	}
+
+	return nil
+}
+
+var checkPoolInstanceDelay = delay.Func("checkPoolInstance",
+	checkPoolInstance)
+
+func checkPoolInstance(c appengine.Context, id string) error {
+
+	c = withLogFields(c, &logFields{InstanceID: id})
+
+	key := datastore.NewKey(c, "PoolInstance", id, 0, nil)
+
+	var p PoolInstance
+	if err := datastore.Get(c, key, &p); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+
+	// Healthy instances also tell us what they can do now, so we learn
+	// of instances which have changed since we last asked, and of
+	// instances pooled before we asked at all.
+	healthy := false
+	var caps Capabilities
+	for i := 0; i < healthCheckAttempts && !healthy; i++ {
+		var err error
+		if err = p.Instance.checkHealth(c); err == nil {
+			caps, _, err = p.Instance.getCapabilities(c)
+		}
+		if err != nil {
+			c.Infof("Health check failed: %s", err)
+		} else {
+			healthy = true
+		}
+	}
+	checkTime := time.Now()
+
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var current PoolInstance
+		if err := datastore.Get(c, key, &current); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+
+		// If the instance was taken by a job and returned since
+		// we checked it, our result is stale; leave it for next time.
+		if !current.PoolAddTime.Equal(p.PoolAddTime) {
+			return nil
+		}
+
+		// Instances too old to run any job would otherwise sit in
+		// the pool forever, so we get rid of them like dead ones.
+		if healthy && caps.Version >= minDreamServerVersion {
+			current.LastHealthyTime = checkTime
+			current.Instance.Capabilities = caps
+			_, err := datastore.Put(c, key, &current)
+			return err
+		}
+
+		if err := datastore.Delete(c, key); err != nil {
+			return err
+		}
+		if healthy {
+			c.Warningf("Removing instance speaking protocol version %d from pool.", caps.Version)
+		} else {
+			c.Warningf("Removing unresponsive instance from pool.")
+		}
+		terminateInstanceDelay.Call(c, current.Instance.ID)
+
+		return nil
+	}, nil)
+}
+
+// Returns whether this pool instance has been seen working recently
+// enough that we're willing to give it to a job.
+// Instances freshly returned to the pool count as healthy,
+// since a job has just finished using them.
+func (p *PoolInstance) recentlyHealthy() bool {
+
+	lastSeen := p.PoolAddTime
+	if p.LastHealthyTime.After(lastSeen) {
+		lastSeen = p.LastHealthyTime
+	}
+
+	return time.Now().Add(-poolHealthMaxAge).Before(lastSeen)
+}
+
+// Ping the instance's dream server over our pinned TLS connection,
+// returning an error if it doesn't answer in time.
+func (i *Instance) checkHealth(c appengine.Context) error {
+
+	ip, err := i.publicIP(c)
+	if err != nil {
+		return err
+	}
+
+	client, err := i.httpClient(c)
+	if err != nil {
+		return err
+	}
+	client.Timeout = healthCheckTimeout
+
+	start := time.Now()
+	resp, err := client.Get("https://" + ip + ":8080/dream")
+	recordDreamServerRequest(c, "health", start)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errors.New("Dream server returned " + resp.Status)
+	}
+
+	return nil
+}
@@ -1,12 +1,12 @@
 package job
 
 import (
-	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"io"
 	"mime/multipart"
 	"net"
 	"net/http"
@@ -20,8 +20,12 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 
 	"config"
+	"storage"
 )
 
+// How long a request to a dream server may take.
+const dreamServerTimeout = 5 * time.Minute
+
 var (
 	dreamServerAmi          = config.Get("DREAMPICS_DREAMSERVER_AMI")
 	dreamServerInstanceType = config.Get("DREAMPICS_DREAMSERVER_INSTANCE_TYPE")
@@ -64,6 +68,13 @@ type Instance struct {
 
 	// The public IP address associated with this instance.
 	IP string
+
+	// The EC2 instance type we launched.
+	Type string
+
+	// What the instance's dream server can do.
+	// Unknown until it first passes a liveness check.
+	Capabilities Capabilities
 }
 
 // Launch a new instance, setting ID and launch time.
@@ -103,14 +114,20 @@ func (i *Instance) launch(c appengine.Context, clientToken string) (err error) {
 		SecurityGroups: []*string{aws.String(awsSecurityGroup)},
 	}
 
+	c.Infof("Launching %s instance.", dreamServerInstanceType)
+
 	var runResult *ec2.Reservation
 	runResult, err = svc.RunInstances(params)
+	recordEC2Request(c, "RunInstances", err)
 	if err != nil {
+		c.Warningf("Launching instance failed: %s", err)
 		return
 	}
 
 	i.ID = *runResult.Instances[0].InstanceID
+	c.Infof("Launched instance %s.", i.ID)
 	i.LaunchTime = time.Now()
+	i.Type = dreamServerInstanceType
 
 	// Stop storing the private key now we've
 	// passed it to the instance and no longer need it.
@@ -137,56 +154,67 @@ func (i *Instance) get(c appengine.Context, pathAndQuery string) (resp *http.Res
 	// If it's unavailable, then we immediately fail the request.
 	ip, err := i.publicIP(c)
 	if err != nil {
-		c.Infof("Instance IP lookup failed: " + err.Error())
+		c.Infof("Instance IP lookup failed: %s", err)
 		return nil, err
 	}
 
 	// Construct our HTTP client for talking to the instance.
 	client, err := i.httpClient(c)
 	if err != nil {
-		c.Infof("Instance HTTP Client setup failed: " + err.Error())
+		c.Infof("Instance HTTP Client setup failed: %s", err)
 		return nil, err
 	}
 
 	// Make the request.
+	start := time.Now()
 	resp, err = client.Get("https://" + ip + ":8080/" + pathAndQuery)
+	recordDreamServerRequest(c, "get", start)
 	if err != nil {
-		c.Infof("Instance HTTP GET failed: " + err.Error())
+		c.Infof("Instance HTTP GET failed: %s", err)
 		return nil, err
 	}
 
 	return resp, nil
 }
 
-// Make a HTTP POST request to our instance.
+// A file to send to our instance, in the given field of a multipart form.
+type formFile struct {
+	Field string
+
+	// The cloud storage object to send.
+	Data string
+}
+
+// Make a HTTP POST request to our instance, sending the given files.
+// The files are streamed from storage as they're sent,
+// rather than read into memory first.
 // Same response semantics as http.Client's PostForm.
-func (i *Instance) postFile(c appengine.Context, pathAndQuery, filename string, file []byte) (
+func (i *Instance) postFile(c appengine.Context, pathAndQuery string, files ...formFile) (
 	resp *http.Response, err error) {
 
-	data, contentType, err := encodeFile(filename, file)
-	if err != nil {
-		return nil, err
-	}
-
 	// Try to get the public IP for this instance.
 	// If it's unavailable, then we immediately fail the request.
 	ip, err := i.publicIP(c)
 	if err != nil {
-		c.Infof("Instance IP lookup failed: " + err.Error())
+		c.Infof("Instance IP lookup failed: %s", err)
 		return nil, err
 	}
 
 	// Construct our HTTP client for talking to the instance.
 	client, err := i.httpClient(c)
 	if err != nil {
-		c.Infof("Instance HTTP Client setup failed: " + err.Error())
+		c.Infof("Instance HTTP Client setup failed: %s", err)
 		return nil, err
 	}
 
-	// Make the request.
+	// Make the request. If it fails, the client closes the body,
+	// which stops us encoding the files.
+	data, contentType := encodeFiles(c, files)
+	start := time.Now()
 	resp, err = client.Post("https://" + ip + ":8080/" + pathAndQuery, contentType, data)
+	recordDreamServerRequest(c, "post", start)
 	if err != nil {
-		c.Infof("Instance HTTP POST failed: " + err.Error())
+		c.Infof("Instance HTTP POST failed: %s", err)
 		return nil, err
 	}
 
@@ -220,12 +248,13 @@ func (i *Instance) httpClient(c appengine.Context) (client *http.Client, err err
 
 			// If we don't do this step,
 			// sockets time out after five seconds.
-			// This is not conductive to our longer requests.
-			err = conn.SetReadDeadline(time.Now().Add(50 * time.Minute))
+			// That's too short to send or fetch a large image,
+			// though dreams themselves run asynchronously.
+			err = conn.SetReadDeadline(time.Now().Add(dreamServerTimeout))
 			if err != nil {
 				return nil, err
 			}
-			err = conn.SetWriteDeadline(time.Now().Add(50 * time.Minute))
+			err = conn.SetWriteDeadline(time.Now().Add(dreamServerTimeout))
 			if err != nil {
 				return nil, err
 			}
@@ -256,6 +285,7 @@ func (i *Instance) publicIP(c appengine.Context) (ip string, err error) {
 	}
 
 	descResult, err := svc.DescribeInstances(params)
+	recordEC2Request(c, "DescribeInstances", err)
 	if err != nil {
 		return "", err
 	}
@@ -281,22 +311,43 @@ func (i *Instance) terminate(c appengine.Context) error {
 	}
 
 	_, err := svc.TerminateInstances(params)
+	recordEC2Request(c, "TerminateInstances", err)
 	return err
 }
 
-func encodeFile(field string, file []byte) (data *bytes.Buffer, contentType string, err error) {
+// Returns a multipart form of the given files, encoded as it's read.
+func encodeFiles(c appengine.Context, files []formFile) (data io.ReadCloser, contentType string) {
+
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+
+	go func() {
+		for _, file := range files {
+			if err := copyFormFile(c, w, file); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(w.Close())
+	}()
+
+	return pr, w.FormDataContentType()
+}
 
-	buf := new(bytes.Buffer)
-	w := multipart.NewWriter(buf)
+// Copy a file from storage into a multipart form.
+func copyFormFile(c appengine.Context, w *multipart.Writer, file formFile) error {
 
-	fileWriter, err := w.CreateFormFile(field, field)
+	rc, err := storage.OpenFile(c, file.Data)
 	if err != nil {
-		return nil, "", err
+		return err
 	}
-	if _, err = fileWriter.Write(file); err != nil {
-		return nil, "", err
+	defer rc.Close()
+
+	fileWriter, err := w.CreateFormFile(file.Field, file.Field)
+	if err != nil {
+		return err
 	}
-	w.Close()
 
-	return buf, w.FormDataContentType(), nil
+	_, err = io.Copy(fileWriter, rc)
+	return err
 }
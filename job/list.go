@@ -0,0 +1,78 @@
+package job
+
+import (
+	"appengine"
+	"appengine/datastore"
+)
+
+// Returns the most recently created jobs, newest first.
+func RecentJobs(c appengine.Context, limit int) (jobs []*State, err error) {
+
+	q := datastore.NewQuery("Job").
+		Order("-CreateTime").
+		Limit(limit)
+
+	_, err = q.GetAll(c, &jobs)
+	return jobs, err
+}
+
+// Returns every job which currently holds an instance.
+func JobsHoldingInstances(c appengine.Context) (jobs []*State, err error) {
+
+	statuses := []Status{
+		StatusMustLaunchInstance,
+		StatusLaunchingInstance,
+		StatusHaveInstance,
+		StatusFinishedWithInstance,
+	}
+	for _, status := range statuses {
+		q := datastore.NewQuery("Job").
+			Filter("Status =", int64(status))
+
+		if _, err = q.GetAll(c, &jobs); err != nil {
+			return nil, err
+		}
+	}
+
+	return jobs, nil
+}
+
+// Returns every instance currently in the pool.
+func PoolInstances(c appengine.Context) (instances []*PoolInstance, err error) {
+
+	q := datastore.NewQuery("PoolInstance").
+		Order("-PoolAddTime")
+
+	_, err = q.GetAll(c, &instances)
+	return instances, err
+}
+
+// A job's change of status, along with the job it belongs to.
+type JobLogEntry struct {
+	JobID string
+	JobLog
+}
+
+// Returns the most recent changes of status across all jobs, newest first.
+func RecentJobLogs(c appengine.Context, limit int) (entries []JobLogEntry, err error) {
+
+	q := datastore.NewQuery("JobLog").
+		Order("-Time").
+		Limit(limit)
+
+	var logs []JobLog
+	keys, err := q.GetAll(c, &logs)
+	if err != nil {
+		return nil, err
+	}
+
+	entries = make([]JobLogEntry, len(logs))
+	for i, log := range logs {
+		entries[i] = JobLogEntry{
+			JobID:  keys[i].Parent().StringID(),
+			JobLog: log,
+		}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,183 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/log"
+)
+
+// Fields identifying what a log entry concerns.
+// Entries are logged as JSON objects carrying these, so we can find
+// every entry about a job, rather than searching the logs by time.
+type logFields struct {
+	JobID      string `json:"job_id,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Task       string `json:"task,omitempty"`
+}
+
+// Update the fields to describe the given job as it is now.
+func (f *logFields) setJob(s *State) {
+	f.JobID = s.ID
+	f.InstanceID = s.Instance.ID
+	f.Status = s.Status.String()
+}
+
+// A structured log entry, as logged.
+type logLine struct {
+	logFields
+	Message string `json:"msg"`
+}
+
+// A context which tags everything logged through it with the given fields.
+// The fields are shared, so they may be updated as processing moves on,
+// including from within transactions run from the context.
+type logContext struct {
+	appengine.Context
+	fields *logFields
+}
+
+// Returns a context which tags everything logged through it with the given fields.
+// If c is already a logging context, fields left empty are taken from its fields.
+// This must not be called on a transaction context from a logging context,
+// or entries will be tagged twice; update the existing fields instead.
+func withLogFields(c appengine.Context, fields *logFields) appengine.Context {
+	if parent, ok := c.(*logContext); ok {
+		if fields.JobID == "" {
+			fields.JobID = parent.fields.JobID
+		}
+		if fields.InstanceID == "" {
+			fields.InstanceID = parent.fields.InstanceID
+		}
+		if fields.Status == "" {
+			fields.Status = parent.fields.Status
+		}
+		if fields.Task == "" {
+			fields.Task = parent.fields.Task
+		}
+		c = parent.Context
+	}
+	return &logContext{c, fields}
+}
+
+func (c *logContext) format(format string, args []interface{}) string {
+	line, err := json.Marshal(&logLine{*c.fields, fmt.Sprintf(format, args...)})
+	if err != nil {
+		return fmt.Sprintf(format, args...)
+	}
+	return string(line)
+}
+
+func (c *logContext) Debugf(format string, args ...interface{}) {
+	c.Context.Debugf("%s", c.format(format, args))
+}
+
+func (c *logContext) Infof(format string, args ...interface{}) {
+	c.Context.Infof("%s", c.format(format, args))
+}
+
+func (c *logContext) Warningf(format string, args ...interface{}) {
+	c.Context.Warningf("%s", c.format(format, args))
+}
+
+func (c *logContext) Errorf(format string, args ...interface{}) {
+	c.Context.Errorf("%s", c.format(format, args))
+}
+
+func (c *logContext) Criticalf(format string, args ...interface{}) {
+	c.Context.Criticalf("%s", c.format(format, args))
+}
+
+// A log entry about a job.
+type LogEntry struct {
+	Time       time.Time
+	Level      string
+	InstanceID string
+	Status     string
+	Task       string
+	Message    string
+}
+
+var logLevels = []string{"Debug", "Info", "Warning", "Error", "Critical"}
+
+// The most request logs we'll look through for a job's entries.
+const maxLogSearchRecords = 20000
+
+// Search the application logs for entries about the job,
+// optionally only those whose message contains the given text.
+// Returns entries oldest first.
+func (s *State) SearchLogs(c appengine.Context, text string) (entries []LogEntry, err error) {
+
+	// Only look at logs from around the time the job was running.
+	start := s.CreateTime.Add(-time.Minute)
+	end := time.Now()
+	if s.Status.Final() {
+		end = s.StatusTime.Add(time.Minute)
+	}
+
+	q := &log.Query{
+		StartTime:  start,
+		EndTime:    end,
+		AppLogs:    true,
+		Incomplete: true,
+	}
+
+	marker := `"job_id":` + jsonString(s.ID)
+	result := q.Run(c)
+	for i := 0; i < maxLogSearchRecords; i++ {
+		record, err := result.Next()
+		if err == log.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, appLog := range record.AppLogs {
+			if !strings.Contains(appLog.Message, marker) {
+				continue
+			}
+
+			var line logLine
+			if err := json.Unmarshal([]byte(appLog.Message), &line); err != nil {
+				continue
+			}
+			if line.JobID != s.ID || !strings.Contains(line.Message, text) {
+				continue
+			}
+
+			level := "Unknown"
+			if appLog.Level >= 0 && appLog.Level < len(logLevels) {
+				level = logLevels[appLog.Level]
+			}
+
+			entries = append(entries, LogEntry{
+				Time:       appLog.Time,
+				Level:      level,
+				InstanceID: line.InstanceID,
+				Status:     line.Status,
+				Task:       line.Task,
+				Message:    line.Message,
+			})
+		}
+	}
+
+	sort.Sort(logEntriesByTime(entries))
+	return entries, nil
+}
+
+func jsonString(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
+
+type logEntriesByTime []LogEntry
+
+func (l logEntriesByTime) Len() int           { return len(l) }
+func (l logEntriesByTime) Less(i, j int) bool { return l[i].Time.Before(l[j].Time) }
+func (l logEntriesByTime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
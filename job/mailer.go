@@ -0,0 +1,54 @@
+package job
+
+import (
+	"strings"
+
+	"appengine"
+	"appengine/mail"
+)
+
+// Sends email on our behalf.
+type Mailer interface {
+	Send(c appengine.Context, msg *mail.Message) error
+	SendToAdmins(c appengine.Context, msg *mail.Message) error
+}
+
+// The mailer we send email with.
+// The development server can't send email, so there we just log it.
+var mailer Mailer = newMailer()
+
+func newMailer() Mailer {
+	if appengine.IsDevAppServer() {
+		return logMailer{}
+	}
+	return appEngineMailer{}
+}
+
+// Sends email using the App Engine mail API.
+type appEngineMailer struct{}
+
+func (appEngineMailer) Send(c appengine.Context, msg *mail.Message) error {
+	return mail.Send(c, msg)
+}
+
+func (appEngineMailer) SendToAdmins(c appengine.Context, msg *mail.Message) error {
+	return mail.SendToAdmins(c, msg)
+}
+
+// Logs email instead of sending it, for local testing.
+type logMailer struct{}
+
+func (logMailer) Send(c appengine.Context, msg *mail.Message) error {
+	c.Infof("Not sending email to %s: %s\n%s", strings.Join(msg.To, ", "), msg.Subject, msg.Body)
+	return nil
+}
+
+func (logMailer) SendToAdmins(c appengine.Context, msg *mail.Message) error {
+	c.Infof("Not sending email to admins: %s\n%s", msg.Subject, msg.Body)
+	return nil
+}
+
+// Returns the address we send email from.
+func mailSender(c appengine.Context) string {
+	return "Dreampics <noreply@" + appengine.AppID(c) + ".appspotmail.com>"
+}
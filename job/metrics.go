@@ -0,0 +1,87 @@
+package job
+
+import (
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"metrics"
+)
+
+var (
+	statusLabel = metrics.Label{
+		Name: "status",
+		Values: []string{
+			StatusNew.String(),
+			StatusMustLaunchInstance.String(),
+			StatusLaunchingInstance.String(),
+			StatusHaveInstance.String(),
+			StatusFinishedWithInstance.String(),
+			StatusDone.String(),
+			StatusFailed.String(),
+			StatusTimedOut.String(),
+			StatusDeadLettered.String(),
+			StatusQueued.String(),
+			StatusWaitingForInstance.String(),
+		},
+	}
+
+	ec2OperationLabel = metrics.Label{
+		Name:   "operation",
+		Values: []string{"RunInstances", "DescribeInstances", "TerminateInstances"},
+	}
+
+	jobsCreated = metrics.NewCounter("dreampics_jobs_created_total",
+		"Jobs created.")
+
+	jobsFinished = metrics.NewCounter("dreampics_jobs_finished_total",
+		"Jobs which reached a final status, by that status.",
+		statusLabel)
+
+	statusDuration = metrics.NewHistogram("dreampics_job_status_duration_seconds",
+		"Time jobs spent in each status before leaving it.",
+		[]float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+		statusLabel)
+
+	instanceAssignments = metrics.NewCounter("dreampics_instance_assignments_total",
+		"Instances given to jobs, by whether they came from the pool or were launched.",
+		metrics.Label{Name: "source", Values: []string{"pool", "launch"}})
+
+	ec2Requests = metrics.NewCounter("dreampics_ec2_requests_total",
+		"Requests made to the EC2 API.",
+		ec2OperationLabel)
+
+	ec2Errors = metrics.NewCounter("dreampics_ec2_errors_total",
+		"Requests to the EC2 API which failed.",
+		ec2OperationLabel)
+
+	webhookDeliveries = metrics.NewCounter("dreampics_webhook_deliveries_total",
+		"Webhooks which were delivered, or which we gave up on delivering.",
+		metrics.Label{Name: "result", Values: []string{"delivered", "gave_up"}})
+
+	dreamServerLatency = metrics.NewHistogram("dreampics_dreamserver_request_duration_seconds",
+		"Time taken by requests to dream servers, by request type.",
+		[]float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1200},
+		metrics.Label{Name: "request", Values: []string{"get", "post", "health"}})
+
+	_ = metrics.NewGaugeFunc("dreampics_pool_size",
+		"Idle instances currently in the pool.",
+		poolSize)
+)
+
+func poolSize(c appengine.Context) (float64, error) {
+	count, err := datastore.NewQuery("PoolInstance").KeysOnly().Count(c)
+	return float64(count), err
+}
+
+func recordEC2Request(c appengine.Context, operation string, err error) {
+	ec2Requests.Inc(c, operation)
+	if err != nil {
+		ec2Errors.Inc(c, operation)
+	}
+}
+
+func recordDreamServerRequest(c appengine.Context, request string, start time.Time) {
+	dreamServerLatency.Observe(c, time.Since(start).Seconds(), request)
+}
@@ -0,0 +1,129 @@
+package job
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	netmail "net/mail"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/image"
+	"appengine/mail"
+)
+
+// Users may ask to be emailed when their job finishes,
+// with a link to the job and a thumbnail of the result if it succeeded,
+// or an apology if it failed.
+
+// The size of the thumbnail of the output we put in emails, in pixels.
+const notifyThumbnailSize = 320
+
+// Check that an address given for notification looks like an email address.
+func validateNotifyEmail(address string) error {
+	if _, err := netmail.ParseAddress(address); err != nil {
+		return errors.New("Not a valid email address: " + address)
+	}
+	return nil
+}
+
+// Schedule emailing the job's owner, if they asked to be,
+// about the final status the job is moving to.
+// Must be run in a transaction.
+func (s *State) scheduleNotification(newStatus Status, c appengine.Context) {
+	if s.NotifyEmail == "" {
+		return
+	}
+
+	notifyDelay.Call(c, s.ID, newStatus)
+}
+
+var notifyDelay = delay.Func("notify", notify)
+
+var (
+	notifyDoneTemplate = template.Must(template.New("done").Parse(
+		`<p>Your dream has finished.</p>
+<p><a href="{{.JobURL}}">{{if .ThumbnailURL}}<img src="{{.ThumbnailURL}}" alt="Your dream"><br>{{end}}See the result.</a></p>
+`))
+
+	notifyFailedTemplate = template.Must(template.New("failed").Parse(
+		`<p>Sorry, we weren't able to finish your dream.</p>
+<p>Details are on <a href="{{.JobURL}}">its page</a>.</p>
+`))
+)
+
+// Email the job's owner that it reached the given final status.
+func notify(c appengine.Context, jobID string, status Status) error {
+
+	c = withLogFields(c, &logFields{JobID: jobID})
+
+	s := &State{ID: jobID}
+	if err := datastore.Get(c, s.GetKey(c), s); err != nil {
+		return err
+	}
+
+	data := struct {
+		JobURL       string
+		ThumbnailURL string
+	}{
+		JobURL: "https://" + appengine.DefaultVersionHostname(c) + "/job/" + s.ID,
+	}
+
+	msg := &mail.Message{
+		Sender: mailSender(c),
+		To:     []string{s.NotifyEmail},
+	}
+
+	tmpl := notifyFailedTemplate
+	if status == StatusDone {
+		tmpl = notifyDoneTemplate
+		msg.Subject = "Your dream is ready"
+		msg.Body = "Your dream has finished. See the result at:\n\n" + data.JobURL + "\n"
+
+		// A missing thumbnail isn't worth failing the email over.
+		thumbnailURL, err := s.thumbnailURL(c)
+		if err != nil {
+			c.Warningf("Failed to get thumbnail for email: %s", err)
+		} else {
+			data.ThumbnailURL = thumbnailURL
+		}
+	} else {
+		msg.Subject = "Sorry, your dream failed"
+		msg.Body = "Sorry, we weren't able to finish your dream. Details are at:\n\n" +
+			data.JobURL + "\n"
+	}
+
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return err
+	}
+	msg.HTMLBody = body.String()
+
+	if err := mailer.Send(c, msg); err != nil {
+		return err
+	}
+	c.Infof("Emailed %s that the job finished.", s.NotifyEmail)
+
+	return nil
+}
+
+// Returns the URL of a thumbnail of the job's output.
+func (s *State) thumbnailURL(c appengine.Context) (string, error) {
+
+	blobKey, err := blobstore.BlobKeyForFile(c, s.OutputData)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := image.ServingURL(c, blobKey, &image.ServingURLOptions{
+		Secure: true,
+		Size:   notifyThumbnailSize,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
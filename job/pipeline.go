@@ -0,0 +1,381 @@
+package job
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"config"
+	"storage"
+)
+
+// Jobs may be given a pipeline: an ordered list of steps, each taking the
+// previous step's output as its input, and storing its own, so every
+// intermediate result can be seen. Dream steps run on the job's instance,
+// and the rest run here, while the job holds its instance.
+// Jobs without a pipeline dream once, with the dream server's defaults.
+//
+// Pipeline stages are called steps here, so as not to be confused
+// with the stages of a job's timeline.
+
+var (
+	// The most steps we allow in a pipeline.
+	maxPipelineSteps = config.GetInt("PIPELINE_MAX_STEPS", 10)
+
+	// The cloud storage object of the image watermark steps overlay.
+	watermarkImage = config.Get("WATERMARK_IMAGE")
+
+	// The most pixels an image made by a step may have.
+	maxStepOutputPixels = config.GetInt("PIPELINE_MAX_OUTPUT_PIXELS", 16<<20)
+)
+
+const (
+	// The longest side preprocess steps shrink images to if not told.
+	defaultPreprocessMaxSize = 1024
+
+	// The longest side preprocess steps may be told to shrink images to.
+	maxPreprocessMaxSize = 1 << 14
+
+	// The most upscale steps may scale images by.
+	maxUpscaleFactor = 4.0
+
+	// How far watermarks are drawn from the corner of the image, in pixels.
+	watermarkMargin = 16
+
+	// How much longer than usual a job may take for each dream step after the first.
+	pipelineDreamTimeout = 15 * time.Minute
+)
+
+// An operation a pipeline step performs.
+type StepOp string
+
+const (
+	// Shrinks the image to fit within max_size pixels on its longest side.
+	StepPreprocess StepOp = "preprocess"
+
+	// Dreams the image, passing the step's parameters on to the dream server.
+	StepDream StepOp = "dream"
+
+	// Scales the image up by factor, which defaults to 2.
+	StepUpscale StepOp = "upscale"
+
+	// Overlays our watermark in the bottom right corner of the image.
+	StepWatermark StepOp = "watermark"
+)
+
+// All step operations, in the order we list them.
+var StepOps = []StepOp{
+	StepPreprocess,
+	StepDream,
+	StepUpscale,
+	StepWatermark,
+}
+
+func (op StepOp) Description() string {
+	switch op {
+	case StepPreprocess:
+		return "Preprocessing image..."
+	case StepDream:
+		return "Dreaming..."
+	case StepUpscale:
+		return "Upscaling image..."
+	case StepWatermark:
+		return "Adding watermark..."
+	}
+
+	return "Step is unknown."
+}
+
+// One step of a job's pipeline.
+type PipelineStep struct {
+	Op StepOp `datastore:",noindex"`
+
+	// Parameters for the step, URL query encoded.
+	Params string `datastore:",noindex"`
+}
+
+// Parse a pipeline written one step per line, as the step's operation,
+// optionally followed by a space and its URL query encoded parameters:
+//
+//	preprocess max_size=800
+//	dream octaves=4&iterations=10
+//	upscale
+//
+// Blank lines are ignored.
+func ParsePipeline(text string) (steps []PipelineStep, err error) {
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		step := PipelineStep{Op: StepOp(parts[0])}
+		if len(parts) == 2 {
+			step.Params = strings.TrimSpace(parts[1])
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, validatePipeline(steps)
+}
+
+// Check a pipeline is one we can run.
+func validatePipeline(steps []PipelineStep) error {
+
+	if len(steps) == 0 {
+		return nil
+	}
+	if len(steps) > maxPipelineSteps {
+		return fmt.Errorf("Pipelines may have at most %d steps.", maxPipelineSteps)
+	}
+
+	// Once a step has shrunk images, we know how big later steps can
+	// make them, going by the longest side, and taking dreams to keep
+	// their size. Until then, we can only check when the step runs.
+	longest := 0.0
+
+	dreams := 0
+	for i, step := range steps {
+		params, err := url.ParseQuery(step.Params)
+		if err != nil {
+			return fmt.Errorf("Step %d has bad parameters: %s", i+1, err)
+		}
+
+		switch step.Op {
+		case StepPreprocess:
+			maxSize, err := intParam(params, "max_size", defaultPreprocessMaxSize, 1, maxPreprocessMaxSize)
+			if err != nil {
+				return fmt.Errorf("Step %d: %s", i+1, err)
+			}
+			if longest == 0 || float64(maxSize) < longest {
+				longest = float64(maxSize)
+			}
+		case StepDream:
+			dreams++
+		case StepUpscale:
+			factor, err := floatParam(params, "factor", 2, 1, maxUpscaleFactor)
+			if err != nil {
+				return fmt.Errorf("Step %d: %s", i+1, err)
+			}
+			if longest > 0 {
+				longest *= factor
+				if longest*longest > float64(maxStepOutputPixels) {
+					return fmt.Errorf("Step %d could make images up to %d pixels square; "+
+						"the most pixels we allow is %d.", i+1, int(longest), maxStepOutputPixels)
+				}
+			}
+		case StepWatermark:
+			if watermarkImage == "" {
+				return fmt.Errorf("Step %d: no watermark is configured.", i+1)
+			}
+		default:
+			return fmt.Errorf("Step %d has unknown operation %q.", i+1, step.Op)
+		}
+	}
+
+	// We only get an instance for dreaming, so a pipeline without a dream
+	// would hold one for nothing.
+	if dreams == 0 {
+		return errors.New("Pipelines must have at least one dream step.")
+	}
+
+	return nil
+}
+
+// Returns the named integer parameter, or def if it isn't given,
+// checking it's within the given bounds.
+func intParam(params url.Values, name string, def, min, max int) (int, error) {
+	if params.Get(name) == "" {
+		return def, nil
+	}
+
+	value, err := strconv.Atoi(params.Get(name))
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("%s must be a whole number from %d to %d.", name, min, max)
+	}
+	return value, nil
+}
+
+// Returns the named number parameter, or def if it isn't given,
+// checking it's over min and at most max.
+func floatParam(params url.Values, name string, def, min, max float64) (float64, error) {
+	if params.Get(name) == "" {
+		return def, nil
+	}
+
+	value, err := strconv.ParseFloat(params.Get(name), 64)
+	if err != nil || value <= min || value > max {
+		return 0, fmt.Errorf("%s must be a number over %g and at most %g.", name, min, max)
+	}
+	return value, nil
+}
+
+// Returns the task which runs the job's next pipeline step.
+func (s *State) nextStepTask() Task {
+	if s.Pipeline[len(s.StepOutputs)].Op == StepDream {
+		return TaskDream
+	}
+	return TaskRunStep
+}
+
+// Returns the job's current pipeline step, counting from zero,
+// or the number of steps if it's finished them all.
+func (s *State) CurrentStep() int {
+	return len(s.StepOutputs)
+}
+
+// Returns the name to store the output of the given step of the job's pipeline under.
+func stepOutputName(s *State, i int) string {
+	return fmt.Sprintf("job/%s/step-%02d-%s", s.ID, i, s.Pipeline[i].Op)
+}
+
+// Run the job's next pipeline step, which must be one which runs here,
+// storing its output. Dream steps are run as dreams, like any other.
+// Updates taskState to record results.
+func (s *State) runStep(c appengine.Context, taskState *taskState) error {
+
+	i := len(s.StepOutputs)
+	step := s.Pipeline[i]
+
+	params, err := url.ParseQuery(step.Params)
+	if err != nil {
+		return err
+	}
+
+	img, err := readImage(c, s.dreamInput())
+	if err != nil {
+		return err
+	}
+
+	if img, err = applyStep(c, step.Op, params, img); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	if taskState.DreamOutputData, err = storage.WriteFile(c, stepOutputName(s, i), buf.Bytes()); err != nil {
+		return err
+	}
+	taskState.DreamDone = true
+
+	return nil
+}
+
+// Apply a pipeline step which runs here to an image.
+func applyStep(c appengine.Context, op StepOp, params url.Values, img image.Image) (
+	image.Image, error) {
+
+	bounds := img.Bounds()
+	switch op {
+
+	case StepPreprocess:
+		maxSize, err := intParam(params, "max_size", defaultPreprocessMaxSize, 1, maxPreprocessMaxSize)
+		if err != nil {
+			return nil, err
+		}
+
+		longest := bounds.Dx()
+		if bounds.Dy() > longest {
+			longest = bounds.Dy()
+		}
+		if longest <= maxSize {
+			return img, nil
+		}
+
+		scale := float64(maxSize) / float64(longest)
+		width, height := int(float64(bounds.Dx())*scale), int(float64(bounds.Dy())*scale)
+		if err := checkStepOutput(op, width, height); err != nil {
+			return nil, err
+		}
+
+		return resizeImage(img, width, height), nil
+
+	case StepUpscale:
+		factor, err := floatParam(params, "factor", 2, 1, maxUpscaleFactor)
+		if err != nil {
+			return nil, err
+		}
+
+		width, height := int(float64(bounds.Dx())*factor), int(float64(bounds.Dy())*factor)
+		if err := checkStepOutput(op, width, height); err != nil {
+			return nil, err
+		}
+
+		return resizeImage(img, width, height), nil
+
+	case StepWatermark:
+		if err := checkStepOutput(op, bounds.Dx(), bounds.Dy()); err != nil {
+			return nil, err
+		}
+
+		mark, err := readImage(c, watermarkImage)
+		if err != nil {
+			return nil, err
+		}
+
+		out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+
+		markBounds := mark.Bounds()
+		corner := image.Pt(bounds.Dx()-markBounds.Dx()-watermarkMargin,
+			bounds.Dy()-markBounds.Dy()-watermarkMargin)
+		draw.Draw(out, markBounds.Sub(markBounds.Min).Add(corner), mark, markBounds.Min, draw.Over)
+
+		return out, nil
+	}
+
+	return nil, fmt.Errorf("Can't run %q steps here.", op)
+}
+
+// Check an image a step is about to make isn't bigger than we allow,
+// before we allocate it. Pipelines are checked when created as far as
+// they can be, but how big dreams and unshrunk inputs are isn't known
+// until now. Returns a *taskFailure if it's too big.
+func checkStepOutput(op StepOp, width, height int) error {
+	if width*height <= maxStepOutputPixels {
+		return nil
+	}
+
+	return &taskFailure{CauseImageTooBig, fmt.Sprintf(
+		"The %s step would make an image %dx%d; the most pixels we allow is %d.",
+		op, width, height, maxStepOutputPixels)}
+}
+
+// Returns the image scaled to the given size.
+func resizeImage(img image.Image, width, height int) image.Image {
+
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	bounds := img.Bounds()
+	scaleX := float64(bounds.Dx()) / float64(width)
+	scaleY := float64(bounds.Dy()) / float64(height)
+
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			srcX := float64(bounds.Min.X) + (float64(x)+0.5)*scaleX - 0.5
+			srcY := float64(bounds.Min.Y) + (float64(y)+0.5)*scaleY - 0.5
+			out.SetRGBA(x, y, sampleBilinear(img, srcX, srcY))
+		}
+	}
+
+	return out
+}
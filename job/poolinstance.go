@@ -1,6 +1,7 @@
 package job
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
@@ -20,6 +21,10 @@ type PoolInstance struct {
 
 	// The time the instance was added to the pool.
 	PoolAddTime time.Time
+
+	// The last time the instance passed a health check while in the pool.
+	// Zero if it has not been checked since it was added.
+	LastHealthyTime time.Time
 }
 
 func init() {
@@ -88,6 +93,7 @@ func ShrinkPool(c appengine.Context) (err error) {
 		// and in a transaction, check it still meets our
 		// criteria for removal, and if so, remove it.
 		for _, candidateKey := range candidateKeys {
+			c := withLogFields(c, &logFields{InstanceID: candidateKey.StringID()})
 
 			// If we fail to act on a given candidate,
 			// we will just ignore them and try again
@@ -118,6 +124,7 @@ func ShrinkPool(c appengine.Context) (err error) {
 				if err = datastore.Delete(c, candidateKey); err != nil {
 					return err
 				}
+				c.Infof("Removing idle instance from pool, added at %s.", p.PoolAddTime)
 				terminateInstanceDelay.Call(c, p.Instance.ID)
 
 				return nil
@@ -130,11 +137,42 @@ func ShrinkPool(c appengine.Context) (err error) {
 	return nil
 }
 
+var ErrNotInPool = errors.New("Instance is no longer in the pool; a job may have taken it.")
+
+// Remove the given instance from the pool and terminate it.
+// Used by admins to get rid of misbehaving instances.
+// Returns ErrNotInPool if the instance isn't in the pool, such as when
+// a job has taken it since, so we never terminate one a job is using.
+func TerminatePoolInstance(c appengine.Context, id string) error {
+
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		key := datastore.NewKey(c, "PoolInstance", id, 0, nil)
+
+		var p PoolInstance
+		if err := datastore.Get(c, key, &p); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return ErrNotInPool
+			}
+			return err
+		}
+
+		if err := datastore.Delete(c, key); err != nil {
+			return err
+		}
+
+		terminateInstanceDelay.Call(c, id)
+		return nil
+	}, nil)
+}
+
 var terminateInstanceDelay = delay.Func("terminatePoolInstance",
 	terminateInstance)
 
 func terminateInstance(c appengine.Context, id string) error {
 
+	c = withLogFields(c, &logFields{InstanceID: id})
+	c.Infof("Terminating instance.")
+
 	var awsConfig = &aws.Config{
 		HTTPClient: urlfetch.Client(c),
 	}
@@ -145,7 +183,13 @@ func terminateInstance(c appengine.Context, id string) error {
 	}
 
 	_, err := svc.TerminateInstances(params)
-	return err
+	recordEC2Request(c, "TerminateInstances", err)
+	if err != nil {
+		c.Warningf("Terminating instance failed: %s", err)
+		return err
+	}
+
+	return settleInstanceUsage(c, id)
 }
 
 func getCandidatePoolInstances(c appengine.Context, retry bool) (keys []*datastore.Key,
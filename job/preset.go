@@ -0,0 +1,125 @@
+package job
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Presets are named styles, managed by admins, each bundling dream
+// parameters and optionally a guide image, so users can pick a style
+// rather than tune the dream server's parameters themselves.
+// Jobs record the preset they were created with, but take a copy of
+// its settings, so changing a preset doesn't affect jobs already made.
+
+// A named style of dream.
+type Preset struct {
+
+	// The unique name of this preset, shown to users.
+	Name string
+
+	// What the preset's dreams look like, shown to users.
+	Description string `datastore:",noindex"`
+
+	// Parameters passed on to the dream server, URL query encoded.
+	Params string `datastore:",noindex"`
+
+	// The cloud storage object of the image guiding the preset's dreams, if any.
+	GuideData string `datastore:",noindex"`
+
+	// The times the preset was created and last changed.
+	CreateTime time.Time
+	UpdateTime time.Time
+}
+
+// Presets without a name have no key, so are refused before we make one.
+var errNoPresetName = &ValidationError{"Presets must have a name."}
+
+func (p *Preset) GetKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Preset", p.Name, 0, nil)
+}
+
+// Returns every preset, in order of name.
+func Presets(c appengine.Context) (presets []*Preset, err error) {
+	_, err = datastore.NewQuery("Preset").
+		Order("Name").
+		GetAll(c, &presets)
+	return presets, err
+}
+
+// Returns the named preset.
+func GetPreset(c appengine.Context, name string) (*Preset, error) {
+	if name == "" {
+		return nil, errNoPresetName
+	}
+
+	p := &Preset{Name: name}
+	if err := datastore.Get(c, p.GetKey(c), p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Save a new or changed preset.
+func SavePreset(c appengine.Context, p *Preset) error {
+
+	if p.Name == "" {
+		return errNoPresetName
+	}
+	if _, err := url.ParseQuery(p.Params); err != nil {
+		return &ValidationError{fmt.Sprintf("Preset has bad parameters: %s", err)}
+	}
+
+	p.UpdateTime = time.Now()
+	if p.CreateTime.IsZero() {
+		p.CreateTime = p.UpdateTime
+	}
+
+	_, err := datastore.Put(c, p.GetKey(c), p)
+	return err
+}
+
+// Delete the named preset. Jobs already created with it are unaffected.
+func DeletePreset(c appengine.Context, name string) error {
+	if name == "" {
+		return errNoPresetName
+	}
+
+	p := &Preset{Name: name}
+	return datastore.Delete(c, p.GetKey(c))
+}
+
+// Returns how many jobs have been created with the preset.
+func (p *Preset) Uses(c appengine.Context) (int, error) {
+	return datastore.NewQuery("Job").
+		Filter("Preset =", p.Name).
+		KeysOnly().
+		Count(c)
+}
+
+// Fill in any of the options not already given from the chosen preset, if any.
+func (o *Options) applyPreset(c appengine.Context) error {
+	if o.Preset == "" {
+		return nil
+	}
+
+	p, err := GetPreset(c, o.Preset)
+	if err == datastore.ErrNoSuchEntity {
+		return &ValidationError{fmt.Sprintf("No such preset %q.", o.Preset)}
+	}
+	if err != nil {
+		return err
+	}
+
+	if o.DreamParams == "" {
+		o.DreamParams = p.Params
+	}
+	if o.GuideData == "" {
+		o.GuideData = p.GuideData
+	}
+
+	return nil
+}
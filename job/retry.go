@@ -0,0 +1,208 @@
+package job
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+
+	"config"
+)
+
+// Describes how we retry a task which fails during job processing.
+type retryPolicy struct {
+
+	// The number of times the task may fail before we give up on it.
+	MaxAttempts int
+
+	// How long we wait before the first retry.
+	// This doubles for each subsequent retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+
+	// The longest we will wait before a retry.
+	MaxBackoff time.Duration
+
+	// The fraction by which we randomly vary each wait,
+	// so retries of many jobs failing together are spread out.
+	Jitter float64
+}
+
+var retryPolicies = map[Task]retryPolicy{
+	TaskGetPoolInstances: loadRetryPolicy(TaskGetPoolInstances.String(), retryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 5 * time.Second,
+		MaxBackoff:     time.Minute,
+		Jitter:         0.2,
+	}),
+
+	// Liveness checks normally fail a number of times while the
+	// instance boots, and give up by themselves thirty minutes after
+	// launch, so this should allow comfortably more than that.
+	TaskCheckLiveness: loadRetryPolicy(TaskCheckLiveness.String(), retryPolicy{
+		MaxAttempts:    60,
+		InitialBackoff: 10 * time.Second,
+		MaxBackoff:     time.Minute,
+		Jitter:         0.1,
+	}),
+
+	TaskCheckBudget: loadRetryPolicy(TaskCheckBudget.String(), retryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 5 * time.Second,
+		MaxBackoff:     time.Minute,
+		Jitter:         0.2,
+	}),
+
+	TaskRunStep: loadRetryPolicy(TaskRunStep.String(), retryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Second,
+		MaxBackoff:     time.Minute,
+		Jitter:         0.2,
+	}),
+
+	// Running out of dream attempts discards the instance,
+	// rather than the job. Dreams which fail on the dream server
+	// count as failed attempts at submitting them.
+	TaskDream: loadRetryPolicy(TaskDream.String(), retryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 30 * time.Second,
+		MaxBackoff:     5 * time.Minute,
+		Jitter:         0.2,
+	}),
+
+	// Likewise for running out of attempts to poll a dream,
+	// since the instance has stopped answering.
+	TaskPollDream: loadRetryPolicy(TaskPollDream.String(), retryPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: 15 * time.Second,
+		MaxBackoff:     2 * time.Minute,
+		Jitter:         0.2,
+	}),
+}
+
+// Load the named retry policy from config,
+// using def for anything not configured.
+// Config keys are of the form JOB_RETRY_DREAM_MAX_ATTEMPTS.
+func loadRetryPolicy(name string, def retryPolicy) retryPolicy {
+
+	prefix := "JOB_RETRY_" + strings.ToUpper(name) + "_"
+	return retryPolicy{
+		MaxAttempts:    config.GetInt(prefix+"MAX_ATTEMPTS", def.MaxAttempts),
+		InitialBackoff: config.GetDuration(prefix+"INITIAL_BACKOFF", def.InitialBackoff),
+		MaxBackoff:     config.GetDuration(prefix+"MAX_BACKOFF", def.MaxBackoff),
+		Jitter:         config.GetFloat(prefix+"JITTER", def.Jitter),
+	}
+}
+
+// Returns how long to wait before retrying after the given number of attempts.
+func (p retryPolicy) backoff(attempts int) time.Duration {
+
+	backoff := p.InitialBackoff
+	for i := 1; i < attempts && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	jitter := p.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(float64(backoff) * (1 + jitter))
+}
+
+// Record that the given task failed, and schedule a retry of
+// processing the job according to the task's retry policy.
+// If the task has run out of attempts, we give up on the job,
+// moving it to StatusDeadLettered, or for dream failures,
+// give up on its instance and look for another.
+// Tasks failing with a *taskFailure fail the job without retrying.
+//
+// Does nothing if the job has moved on since the task was issued.
+func (s *State) retryTask(c appengine.Context, task Task, taskErr error) error {
+
+	status := s.Status
+
+	// If the dream itself failed, polling it again won't help,
+	// so we submit it again instead.
+	_, dreamFailed := taskErr.(*dreamTaskError)
+	if dreamFailed {
+		task = TaskDream
+	}
+	policy := retryPolicies[task]
+
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, s.GetKey(c), s); err != nil {
+			return err
+		}
+
+		if s.Status != status {
+			return nil
+		}
+
+		var putKeys []*datastore.Key
+		var putData []interface{}
+
+		if failure, ok := taskErr.(*taskFailure); ok {
+			s.fail(StatusFailed, failure.cause, failure.message, c, &putKeys, &putData)
+
+			putKeys = append(putKeys, s.GetKey(c))
+			putData = append(putData, s)
+
+			_, err := datastore.PutMulti(c, putKeys, putData)
+			return err
+		}
+
+		s.TaskAttempts++
+		s.TotalTaskFailures++
+		attempts := s.TaskAttempts
+
+		// A dream which keeps failing must use up its attempts,
+		// however well polling it went in between.
+		if dreamFailed {
+			s.DreamTaskID = ""
+			s.DreamFailures++
+			if s.DreamFailures > attempts {
+				attempts = s.DreamFailures
+			}
+		}
+		c.Infof("Task failed on attempt %d of %d: %s", attempts, policy.MaxAttempts, taskErr)
+
+		if attempts < policy.MaxAttempts {
+			if err := scheduleProcessJob(c, s.ID, policy.backoff(attempts)); err != nil {
+				return err
+			}
+		} else if task == TaskDream || task == TaskPollDream {
+			s.discardInstance(taskErr.Error(), c, &taskState{}, &putKeys, &putData)
+			if s.Status == StatusNew {
+				if err := scheduleProcessJob(c, s.ID, 0); err != nil {
+					return err
+				}
+			}
+		} else {
+			s.fail(StatusDeadLettered, CauseRetriesExhausted, taskErr.Error(),
+				c, &putKeys, &putData)
+		}
+
+		putKeys = append(putKeys, s.GetKey(c))
+		putData = append(putData, s)
+
+		_, err := datastore.PutMulti(c, putKeys, putData)
+		return err
+	}, nil)
+}
+
+// Schedule processing of the given job after the given delay.
+// May be run in a transaction, in which case the task is only
+// added if the transaction succeeds.
+func scheduleProcessJob(c appengine.Context, jobID string, delay time.Duration) error {
+
+	t, err := processJobDelay.Task(jobID)
+	if err != nil {
+		return err
+	}
+	t.Delay = delay
+
+	_, err = taskqueue.Add(c, t, "")
+	return err
+}
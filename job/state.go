@@ -1,7 +1,10 @@
 package job
 
 import (
+	"errors"
+	"fmt"
 	"math/rand"
+	"net/url"
 	"time"
 
 	"appengine"
@@ -9,13 +12,31 @@ import (
 	"appengine/delay"
 )
 
-var processJobDelay = delay.Func("processJob", processJob)
+const (
+	// How many instances a job may go through before we fail it.
+	maxInstanceAttempts = 3
+
+	// How long a job may take overall before it is timed out.
+	jobTimeout = 2 * time.Hour
+)
+
+// Set up in init, since processing a job can schedule further processing.
+var processJobDelay *delay.Function
+
+func init() {
+	processJobDelay = delay.Func("processJob", processJob)
+}
 
 func processJob(c appengine.Context, jobID string) (err error) {
 
 	task := TaskNone
 	taskState := &taskState{}
 	state := &State{ID: jobID}
+
+	// Tag everything we log with the job, and where it's up to.
+	fields := &logFields{JobID: jobID}
+	c = withLogFields(c, fields)
+
 	for task != TaskHaltProcessing {
 
 		// Run the next state of transactional processing of the job,
@@ -26,6 +47,7 @@ func processJob(c appengine.Context, jobID string) (err error) {
 			if err := datastore.Get(c, state.GetKey(c), state); err != nil {
 				return err
 			}
+			fields.setJob(state)
 
 			// Process it and get the next task to peform.
 			var err error
@@ -41,16 +63,36 @@ func processJob(c appengine.Context, jobID string) (err error) {
 
 		// If there was an error, return.
 		if err != nil {
+			c.Warningf("Processing job failed: %s", err)
 			return
 		}
+		fields.setJob(state)
+
+		// If we've been told to wait for an instance to become free,
+		// come back and look again later.
+		if task == TaskWaitForInstance {
+			c.Infof("Waiting for an instance to come free in the pool.")
+			return scheduleProcessJob(c, jobID, instanceWaitInterval)
+		}
+
+		// Likewise if our dream is still running.
+		if task == TaskWaitForDream {
+			c.Infof("Waiting for the dream to finish.")
+			return scheduleProcessJob(c, jobID, dreamPollInterval)
+		}
 
 		// If we've been given a non-transactional processing
-		// task to perform, perform it. If it fails, bail out.
-		// We'll retry later. Otherwise passing past here
-		// indicates success.
+		// task to perform, perform it. If it fails, bail out,
+		// scheduling a retry according to the task's retry policy.
+		// Otherwise passing past here indicates success.
+		if task != TaskNone && task != TaskHaltProcessing {
+			fields.Task = task.String()
+			c.Infof("Running task.")
+		}
 		if err = state.doTask(c, task, taskState); err != nil {
-			return
+			return state.retryTask(c, task, err)
 		}
+		fields.Task = ""
 	}
 
 	return
@@ -60,36 +102,197 @@ func processJob(c appengine.Context, jobID string) (err error) {
 type State struct {
 
 	// The unique ID of this job.
-	// Used as a client token when launching the instance.
 	ID string
 
 	// The current status of the job.
 	// Indicates what stage of processing it has reached.
 	Status Status
 
+	// The time the job was created.
+	CreateTime time.Time
+
+	// The time the job entered its current status.
+	StatusTime time.Time
+
+	// The time by which the job must have finished.
+	Deadline time.Time
+
+	// The time at which the job will be timed out if still in its
+	// current status; the earlier of Deadline and the current status's
+	// own time limit. Zero once the job reaches a final status.
+	TimeoutTime time.Time
+
 	// The cloud storage object of the data uploaded for this job.
 	InputData string
 
+	// The size of the job's input, in bytes. Zero until we've looked.
+	InputBytes int64 `datastore:",noindex"`
+
+	// The cloud storage object of the image guiding this job's dreams,
+	// if any.
+	GuideData string `datastore:",noindex"`
+
+	// The name of the preset the job was created with, if any.
+	Preset string
+
+	// Parameters passed on to the dream server, URL query encoded.
+	DreamParams string `datastore:",noindex"`
+
 	// The cloud storage object of the result of this job.
 	OutputData string
 
+	// The time the dream server returned our result,
+	// before we stored it.
+	DreamFinishTime time.Time
+
+	// How long the job has spent in each stage, in seconds,
+	// in the order of Stages. Empty for jobs from before we kept this.
+	StageSeconds []float64 `datastore:",noindex"`
+
 	// The instance assigned to this job.
 	Instance Instance
+
+	// The ID of the task on the instance running our current dream.
+	// Empty if we don't have a dream running.
+	DreamTaskID string `datastore:",noindex"`
+
+	// How many times in a row the dream server has failed our current dream.
+	// Polling a resubmitted dream succeeds until it fails again, so these
+	// are counted separately from task attempts.
+	DreamFailures int `datastore:",noindex"`
+
+	// How far our current dream has got.
+	DreamProgress DreamProgress
+
+	// The client token used when launching our current instance.
+	// Regenerated for every launch, so a replacement instance
+	// isn't mistaken by Amazon for a retry of the last one.
+	// Jobs predating this field use their ID.
+	LaunchToken string
+
+	// The number of times the task for the current status has failed.
+	TaskAttempts int
+
+	// The number of times any task has failed for this job.
+	TotalTaskFailures int
+
+	// The number of instances this job has discarded as dead.
+	InstancesDiscarded int
+
+	// Why the job failed, if it has.
+	FailureCause FailureCause
+
+	// The status the job was in when it failed.
+	FailureStage Status
+
+	// The error which caused the job to fail.
+	FailureMessage string `datastore:",noindex"`
+
+	// The number of task failures the job had seen when it failed.
+	FailureAttempts int
+
+	// The time the job failed. Zero if it hasn't.
+	FailureTime time.Time
+
+	// The number of times an admin has replayed this job after it failed.
+	Replays int
+
+	// The user who created the job. Empty if they weren't logged in.
+	User string
+
+	// The time the job got its current instance up and running.
+	// Zero if it doesn't have one.
+	InstanceAcquireTime time.Time
+
+	// How long the job has held running instances for.
+	InstanceSeconds float64
+
+	// The job's share of the boot time of the instances it used.
+	// Only charged once those instances are terminated.
+	OverheadSeconds float64
+
+	// The instances whose boot time we've charged a share of.
+	OverheadInstances []string `datastore:",noindex"`
+
+	// The cost of the instance time charged to this job so far.
+	Cost float64
+
+	// The URL to notify when the job finishes. Empty for none.
+	CallbackURL string `datastore:",noindex"`
+
+	// The address to email when the job finishes. Empty for none.
+	NotifyEmail string `datastore:",noindex"`
+
+	// The batch the job was submitted in. Empty if it wasn't.
+	BatchID string
+
+	// The job's position in its batch, counting from zero.
+	BatchIndex int
+
+	// For zoom dreams, how many times to dream, zooming in between.
+	// Zero for a single dream.
+	ZoomIterations int
+
+	// How much zoom dreams zoom in between passes.
+	ZoomScale float64
+
+	// The cloud storage objects of each zoom pass's output so far.
+	ZoomFrames []string `datastore:",noindex"`
+
+	// The cloud storage object to dream in the next zoom pass.
+	// Empty to use InputData.
+	ZoomInput string `datastore:",noindex"`
+
+	// The steps to process the job's input through. Empty to just dream.
+	Pipeline []PipelineStep
+
+	// The cloud storage objects of each pipeline step's output so far.
+	StepOutputs []string `datastore:",noindex"`
 }
 
-func Create(c appengine.Context, inputData string) (id string, err error) {
+// Optional settings for a new job.
+type Options struct {
 
-	id, err = generateRandStr(64)
-	if err != nil {
+	// The user creating the job, if known.
+	User string
+
+	// A URL to POST to when the job finishes, if wanted.
+	CallbackURL string
+
+	// An address to email when the job finishes, if wanted.
+	NotifyEmail string
+
+	// The cloud storage object of an image to guide the job's dreams, if wanted.
+	GuideData string
+
+	// The name of a preset to take any settings not given here from, if wanted.
+	Preset string
+
+	// Parameters to pass on to the dream server, URL query encoded.
+	DreamParams string
+
+	// For a zoom dream, how many times to dream, zooming in between.
+	ZoomIterations int
+
+	// How much a zoom dream zooms in between passes. Zero for our default.
+	ZoomScale float64
+
+	// Steps to process the input through, if not just dreaming it.
+	Pipeline []PipelineStep
+}
+
+func Create(c appengine.Context, inputData string, options Options) (id string, err error) {
+
+	if err = options.applyPreset(c); err != nil {
 		return
 	}
 
 	// Create our job's state object.
-	state := &State{
-		ID:        id,
-		Status:    StatusNew,
-		InputData: inputData,
+	state, err := newState(inputData, options)
+	if err != nil {
+		return
 	}
+	id = state.ID
 
 	// Save the state object and schedule processing of the job.
 	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
@@ -103,11 +306,99 @@ func Create(c appengine.Context, inputData string) (id string, err error) {
 	}, nil)
 	if err != nil {
 		state = nil
+	} else {
+		jobsCreated.Inc(c)
 	}
 
 	return
 }
 
+// Returns the state of a new job, ready to be processed.
+func newState(inputData string, options Options) (state *State, err error) {
+
+	if err = options.validate(); err != nil {
+		return nil, &ValidationError{err.Error()}
+	}
+
+	id, err := generateRandStr(64)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	state = &State{
+		ID:          id,
+		Status:      StatusNew,
+		CreateTime:  now,
+		StatusTime:  now,
+		Deadline:    now.Add(jobTimeout),
+		InputData:   inputData,
+		GuideData:   options.GuideData,
+		Preset:      options.Preset,
+		DreamParams: options.DreamParams,
+		User:        options.User,
+		CallbackURL: options.CallbackURL,
+		NotifyEmail: options.NotifyEmail,
+	}
+	state.StageSeconds = make([]float64, len(Stages))
+
+	if options.ZoomIterations > 0 {
+		state.ZoomIterations = options.ZoomIterations
+		state.ZoomScale = options.ZoomScale
+		if state.ZoomScale == 0 {
+			state.ZoomScale = defaultZoomScale
+		}
+		state.Deadline = state.Deadline.Add(
+			time.Duration(options.ZoomIterations-1) * zoomIterationTimeout)
+	}
+
+	if len(options.Pipeline) > 0 {
+		state.Pipeline = options.Pipeline
+		for _, step := range options.Pipeline[1:] {
+			if step.Op == StepDream {
+				state.Deadline = state.Deadline.Add(pipelineDreamTimeout)
+			}
+		}
+	}
+	state.TimeoutTime = state.timeoutTime()
+
+	return state, nil
+}
+
+// An error in what a job was asked to do, rather than in creating it,
+// so the fault of whoever asked.
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// Check the options are ones we can act on.
+func (o *Options) validate() error {
+	if o.CallbackURL != "" {
+		if err := validateCallbackURL(o.CallbackURL); err != nil {
+			return err
+		}
+	}
+	if o.NotifyEmail != "" {
+		if err := validateNotifyEmail(o.NotifyEmail); err != nil {
+			return err
+		}
+	}
+	if _, err := url.ParseQuery(o.DreamParams); err != nil {
+		return fmt.Errorf("Bad dream parameters: %s", err)
+	}
+	if o.ZoomIterations > 0 && len(o.Pipeline) > 0 {
+		return errors.New("Zoom dreams can't have pipelines.")
+	}
+	if err := validateZoom(o.ZoomIterations, o.ZoomScale); err != nil {
+		return err
+	}
+	return validatePipeline(o.Pipeline)
+}
+
 func (s *State) GetKey(c appengine.Context) *datastore.Key {
 	return datastore.NewKey(c, "Job", s.ID, 0, nil)
 }
@@ -129,14 +420,50 @@ func (s *State) process(c appengine.Context, taskState *taskState) (
 	case StatusDone:
 		fallthrough
 	case StatusFailed:
+		fallthrough
+	case StatusTimedOut:
+		fallthrough
+	case StatusDeadLettered:
+		fallthrough
+	case StatusQueued:
+		// Queued jobs are started by their batch's dispatcher.
 		return TaskHaltProcessing, nil
 
+	case StatusWaitingForInstance:
+		fallthrough
 	case StatusNew:
 		if taskState.PoolInstances == nil {
 			return TaskGetPoolInstances, err
 		}
+		if s.InputBytes == 0 {
+			s.InputBytes = taskState.InputBytes
+		}
+
+		var poolInstance *PoolInstance
+		if len(taskState.PoolInstances) != 0 {
+			poolInstance, err = takePoolInstance(c, taskState.PoolInstances, s.requirements())
+			if err != nil {
+				return TaskNone, err
+			}
+		}
 
-		if len(taskState.PoolInstances) == 0 {
+		// Before launching a new instance, make sure we can afford to.
+		// If we can't, we wait for an instance to turn up in the pool,
+		// for as long as the job's deadline allows.
+		if poolInstance == nil && !taskState.BudgetChecked {
+			return TaskCheckBudget, nil
+		}
+		if poolInstance == nil && !taskState.BudgetAllowsLaunch {
+			if s.Status != StatusWaitingForInstance {
+				s.changeStatus(StatusWaitingForInstance, c, &putKeys, &putData)
+				putKeys = append(putKeys, s.GetKey(c))
+				putData = append(putData, s)
+				_, err = datastore.PutMulti(c, putKeys, putData)
+			}
+			return TaskWaitForInstance, err
+		}
+
+		if poolInstance == nil {
 			cert, privKey, err := generateCert()
 			if err != nil {
 				return TaskNone, err
@@ -147,39 +474,33 @@ func (s *State) process(c appengine.Context, taskState *taskState) (
 				return TaskNone, err
 			}
 
+			launchToken, err := generateRandStr(64)
+			if err != nil {
+				return TaskNone, err
+			}
+
+			s.LaunchToken = launchToken
 			s.Instance.Certificate = cert
 			s.Instance.PrivateKey = privKey
 			s.Instance.AuthCode = authCode
 			s.changeStatus(StatusMustLaunchInstance, c, &putKeys, &putData)
+			instanceAssignments.Inc(c, "launch")
 		} else {
-
-			var poolInstance PoolInstance
-			for i := 0; i < 5; i++ {
-				instanceKey := taskState.PoolInstances[
-					rand.Intn(len(taskState.PoolInstances))]
-
-				if err = datastore.Get(c, instanceKey, &poolInstance); err != nil {
-					if err == datastore.ErrNoSuchEntity {
-						continue
-					}
-					return TaskNone, err
-				}
-
-				if err = datastore.Delete(c, instanceKey); err != nil {
-					return TaskNone, err
-				}
-
-				break
-			}
-
 			s.Instance = poolInstance.Instance
+			s.InstanceAcquireTime = time.Now()
 			s.changeStatus(StatusHaveInstance, c, &putKeys, &putData)
+			instanceAssignments.Inc(c, "pool")
 		}
 
 	case StatusMustLaunchInstance:
-		if err = s.Instance.launch(c, s.ID); err != nil {
+		launchToken := s.LaunchToken
+		if launchToken == "" {
+			launchToken = s.ID
+		}
+		if err = s.Instance.launch(c, launchToken); err != nil {
 			return TaskNone, err
 		}
+		s.startInstanceUsage(c, &putKeys, &putData)
 		s.changeStatus(StatusLaunchingInstance, c, &putKeys, &putData)
 
 	case StatusLaunchingInstance:
@@ -187,25 +508,106 @@ func (s *State) process(c appengine.Context, taskState *taskState) (
 			return TaskCheckLiveness, nil
 		}
 		if !taskState.LivenessCheckSuccess {
-			terminateInstanceDelay.Call(c, s.Instance.ID)
-			s.changeStatus(StatusFailed, c, &putKeys, &putData)
+			s.discardInstance("Instance never passed a liveness check.",
+				c, taskState, &putKeys, &putData)
 			break
 		}
+		if err = s.recordInstanceBooted(c, &putKeys, &putData); err != nil {
+			return TaskNone, err
+		}
 		s.Instance.IP = taskState.LivenessCheckPublicIP
+		s.Instance.Capabilities = taskState.LivenessCheckCapabilities
+
+		// Every instance we launch is the same, so if this one can't run
+		// the job, none can. It can still run others, so goes in the pool,
+		// unless it's too old to run any job at all.
+		if err := s.Instance.Capabilities.satisfy(s.requirements()); err != nil {
+			if s.Instance.Capabilities.Version < minDreamServerVersion {
+				s.releaseInstance(c, true)
+			} else {
+				s.returnInstanceToPool(c, &putKeys, &putData)
+			}
+			s.Instance = Instance{}
+			s.fail(StatusFailed, CauseUnsupported, "No dream server can run this job: "+err.Error(),
+				c, &putKeys, &putData)
+			break
+		}
+
+		s.InstanceAcquireTime = time.Now()
 		s.changeStatus(StatusHaveInstance, c, &putKeys, &putData)
 
 	case StatusHaveInstance:
 		if !taskState.DreamDone {
+
+			// Record a dream we've just submitted, so we can find it again
+			// if we're interrupted while it runs.
+			if taskState.DreamTaskID != "" {
+				s.DreamTaskID = taskState.DreamTaskID
+				s.DreamProgress = DreamProgress{}
+				taskState.DreamTaskID = ""
+				break
+			}
+
+			// Record how far a running dream has got, then come back later.
+			if s.DreamTaskID != "" {
+				if !taskState.DreamPolled {
+					return TaskPollDream, nil
+				}
+
+				// Only consecutive failures count against our attempts,
+				// so they start again from here.
+				s.DreamProgress = taskState.DreamProgress
+				s.TaskAttempts = 0
+				putKeys = append(putKeys, s.GetKey(c))
+				putData = append(putData, s)
+				_, err = datastore.PutMulti(c, putKeys, putData)
+				return TaskWaitForDream, err
+			}
+
+			if len(s.Pipeline) > 0 {
+				return s.nextStepTask(), nil
+			}
 			return TaskDream, nil
 		}
+		s.DreamTaskID = ""
+		s.DreamFailures = 0
+		s.DreamProgress = DreamProgress{}
+
+		// Pipeline steps after the last dream leave its finish time alone.
+		if !taskState.DreamFinishTime.IsZero() {
+			s.DreamFinishTime = taskState.DreamFinishTime
+		}
+
+		// Pipelines go on to their next step on the same instance until the last.
+		if len(s.Pipeline) > 0 {
+			s.StepOutputs = append(s.StepOutputs, taskState.DreamOutputData)
+			if len(s.StepOutputs) < len(s.Pipeline) {
+				c.Infof("Finished pipeline step %d of %d.", len(s.StepOutputs), len(s.Pipeline))
+				s.TaskAttempts = 0
+				s.TimeoutTime = s.timeoutTime()
+				taskState.resetDream()
+				break
+			}
+		}
+
+		// Zoom dreams go round again on the same instance until the last pass.
+		if s.zooming() {
+			s.ZoomFrames = append(s.ZoomFrames, taskState.DreamFrameData)
+			if taskState.ZoomNextInput != "" {
+				c.Infof("Finished zoom pass %d of %d.", len(s.ZoomFrames), s.ZoomIterations)
+				s.ZoomInput = taskState.ZoomNextInput
+				s.TaskAttempts = 0
+				s.TimeoutTime = s.timeoutTime()
+				taskState.resetDream()
+				break
+			}
+		}
+
 		s.OutputData = taskState.DreamOutputData
 		s.changeStatus(StatusFinishedWithInstance, c, &putKeys, &putData)
 
 	case StatusFinishedWithInstance:
-		poolInstance := s.Instance.toPoolInstance(c)
-		poolInstanceKey := datastore.NewKey(c, "PoolInstance", poolInstance.Instance.ID, 0, nil)
-		putKeys = append(putKeys, poolInstanceKey)
-		putData = append(putData, poolInstance)
+		s.returnInstanceToPool(c, &putKeys, &putData)
 		s.changeStatus(StatusDone, c, &putKeys, &putData)
 	}
 
@@ -217,6 +619,86 @@ func (s *State) process(c appengine.Context, taskState *taskState) (
 	return TaskNone, err
 }
 
+// Try to take a healthy instance out of the pool from the given candidates,
+// able to meet the given requirements.
+// Must be run in a transaction.
+// Returns nil if none of the candidates we tried were usable.
+func takePoolInstance(c appengine.Context, candidates []*datastore.Key, r dreamRequirements) (
+	poolInstance *PoolInstance, err error) {
+
+	for i := 0; i < 5; i++ {
+		instanceKey := candidates[rand.Intn(len(candidates))]
+
+		var p PoolInstance
+		if err = datastore.Get(c, instanceKey, &p); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, err
+		}
+
+		// Leave instances we haven't seen working lately
+		// for the health checker to deal with.
+		if !p.recentlyHealthy() {
+			continue
+		}
+
+		// Leave instances which can't run the job for other jobs.
+		if err := p.Instance.Capabilities.satisfy(r); err != nil {
+			c.Infof("Pool instance %s can't run job: %s", p.Instance.ID, err)
+			continue
+		}
+
+		if err = datastore.Delete(c, instanceKey); err != nil {
+			return nil, err
+		}
+
+		return &p, nil
+	}
+
+	return nil, nil
+}
+
+// Put the job's current instance back in the pool, for other jobs to use.
+func (s *State) returnInstanceToPool(c appengine.Context,
+	putKeys *[]*datastore.Key,
+	putData *[]interface{}) {
+
+	s.releaseInstance(c, false)
+	poolInstance := s.Instance.toPoolInstance(c)
+	poolInstanceKey := datastore.NewKey(c, "PoolInstance", poolInstance.Instance.ID, 0, nil)
+	*putKeys = append(*putKeys, poolInstanceKey)
+	*putData = append(*putData, poolInstance)
+}
+
+// Give up on the job's current instance as dead, terminating it.
+// The job goes back to looking for an instance,
+// unless it has already been through too many, in which case it fails.
+func (s *State) discardInstance(reason string,
+	c appengine.Context,
+	taskState *taskState,
+	putKeys *[]*datastore.Key,
+	putData *[]interface{}) {
+
+	c.Infof("Discarding instance %s: %s", s.Instance.ID, reason)
+
+	s.releaseInstance(c, true)
+	s.Instance = Instance{}
+	s.DreamTaskID = ""
+	s.DreamFailures = 0
+	s.LaunchToken = ""
+	s.InstancesDiscarded++
+
+	// Anything we learned about the old instance no longer applies.
+	taskState.reset()
+
+	if s.InstancesDiscarded >= maxInstanceAttempts {
+		s.fail(StatusFailed, CauseInstancesExhausted, reason, c, putKeys, putData)
+	} else {
+		s.changeStatus(StatusNew, c, putKeys, putData)
+	}
+}
+
 func (s *State) changeStatus(newStatus Status,
 	c appengine.Context,
 	putKeys *[]*datastore.Key,
@@ -228,13 +710,65 @@ func (s *State) changeStatus(newStatus Status,
 		Time:       time.Now(),
 	}
 	logKey := datastore.NewIncompleteKey(c, "JobLog", s.GetKey(c))
+	c.Infof("Changing status from %s to %s.", s.Status, newStatus)
 
 	*putKeys = append(*putKeys, logKey)
 	*putData = append(*putData, log)
 
+	// Metrics are recorded outside the transaction,
+	// so may overcount slightly if it is retried.
+	if !s.StatusTime.IsZero() {
+		statusDuration.Observe(c, log.Time.Sub(s.StatusTime).Seconds(), s.Status.String())
+	}
+	s.addStageTime(log.Time)
+	if newStatus.Final() {
+		jobsFinished.Inc(c, newStatus.String())
+		s.scheduleWebhook(newStatus, c, putKeys, putData)
+		s.scheduleNotification(newStatus, c)
+
+		// If this fails, the dispatch_batches cron job will catch up.
+		if s.BatchID != "" {
+			if err := s.scheduleBatchDispatch(c); err != nil {
+				c.Errorf("Failed to schedule dispatch of batch %s: %s", s.BatchID, err)
+			}
+		}
+	}
+
 	s.Status = newStatus
+	s.StatusTime = log.Time
+	s.TimeoutTime = s.timeoutTime()
+	s.TaskAttempts = 0
 }
 
+// Returns how long the job took, or has taken so far if still running.
+func (s *State) Duration() time.Duration {
+	if s.Status.Final() {
+		return s.StatusTime.Sub(s.CreateTime)
+	}
+
+	return time.Since(s.CreateTime)
+}
+
+// Returns when the job should be timed out if it stays in its current status.
+func (s *State) timeoutTime() time.Time {
+
+	if s.Status.Final() {
+		return time.Time{}
+	}
+
+	// Statuses without a time limit of their own are bound only by the deadline.
+	timeout := s.Status.Timeout()
+	if timeout == 0 {
+		return s.Deadline
+	}
+
+	t := time.Now().Add(timeout)
+	if !s.Deadline.IsZero() && s.Deadline.Before(t) {
+		t = s.Deadline
+	}
+
+	return t
+}
 
 // Records a job's change of status.
 // Stored as a child entity of the job's state.
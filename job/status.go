@@ -1,5 +1,9 @@
 package job
 
+import (
+	"time"
+)
+
 type Status int
 
 func (status Status) Description() string {
@@ -16,11 +20,67 @@ func (status Status) Description() string {
 		return "Finished."
 	case StatusFailed:
 		return "Failed to process image."
+	case StatusTimedOut:
+		return "Timed out processing image."
+	case StatusDeadLettered:
+		return "Gave up processing image after repeated errors."
+	case StatusQueued:
+		return "Waiting for earlier images in the batch..."
+	case StatusWaitingForInstance:
+		return "Waiting for a dream server to come free..."
 	}
 
 	return "Status is unknown."
 }
 
+func (status Status) String() string {
+	switch status {
+	case StatusNew:
+		return "new"
+	case StatusMustLaunchInstance:
+		return "must_launch_instance"
+	case StatusLaunchingInstance:
+		return "launching_instance"
+	case StatusHaveInstance:
+		return "have_instance"
+	case StatusFinishedWithInstance:
+		return "finished_with_instance"
+	case StatusDone:
+		return "done"
+	case StatusFailed:
+		return "failed"
+	case StatusTimedOut:
+		return "timed_out"
+	case StatusDeadLettered:
+		return "dead_lettered"
+	case StatusQueued:
+		return "queued"
+	case StatusWaitingForInstance:
+		return "waiting_for_instance"
+	}
+
+	return "unknown"
+}
+
+// Returns whether this is a final status, after which the job does no more.
+func (status Status) Final() bool {
+	return status == StatusDone || status.Failed()
+}
+
+// Returns whether this is a final status for a job which didn't succeed.
+func (status Status) Failed() bool {
+	switch status {
+	case StatusFailed:
+		return true
+	case StatusTimedOut:
+		return true
+	case StatusDeadLettered:
+		return true
+	}
+
+	return false
+}
+
 func (status Status) OutputReady() bool {
 	switch status {
 	case StatusFinishedWithInstance:
@@ -32,6 +92,29 @@ func (status Status) OutputReady() bool {
 	return false
 }
 
+// Returns how long a job may stay in this status before it is timed out.
+// Zero means the status has no time limit of its own; either it's final,
+// or the job is waiting, for its batch or for an instance to come free,
+// and only its deadline applies, if it has one yet.
+func (status Status) Timeout() time.Duration {
+	switch status {
+	case StatusNew:
+		return 30 * time.Minute
+	case StatusMustLaunchInstance:
+		return 10 * time.Minute
+	case StatusLaunchingInstance:
+		// Allow for the thirty minute liveness check window.
+		return 35 * time.Minute
+	case StatusHaveInstance:
+		// Allow for a long dream, which we poll for until it's done.
+		return 55 * time.Minute
+	case StatusFinishedWithInstance:
+		return 10 * time.Minute
+	}
+
+	return 0
+}
+
 const (
 	StatusNew Status = iota
 	StatusMustLaunchInstance
@@ -40,5 +123,9 @@ const (
 	StatusFinishedWithInstance
 	StatusDone
 	StatusFailed
+	StatusTimedOut
+	StatusDeadLettered
+	StatusQueued
+	StatusWaitingForInstance
 )
 
@@ -2,9 +2,6 @@ package job
 
 import (
 	"errors"
-	"io/ioutil"
-	"net/http"
-	"strings"
 	"time"
 
 	"appengine"
@@ -21,16 +18,75 @@ const (
 	TaskGetPoolInstances
 	TaskCheckLiveness
 	TaskDream
+	TaskCheckBudget
+	TaskWaitForInstance
+	TaskRunStep
+	TaskPollDream
+	TaskWaitForDream
 )
 
+func (task Task) String() string {
+	switch task {
+	case TaskNone:
+		return "none"
+	case TaskHaltProcessing:
+		return "halt_processing"
+	case TaskGetPoolInstances:
+		return "get_pool_instances"
+	case TaskCheckLiveness:
+		return "check_liveness"
+	case TaskDream:
+		return "dream"
+	case TaskCheckBudget:
+		return "check_budget"
+	case TaskWaitForInstance:
+		return "wait_for_instance"
+	case TaskRunStep:
+		return "run_step"
+	case TaskPollDream:
+		return "poll_dream"
+	case TaskWaitForDream:
+		return "wait_for_dream"
+	}
+
+	return "unknown"
+}
+
 type taskState struct {
 	PoolInstances []*datastore.Key
 	PoolInstancesRetrievedBefore bool
 	LivenessChecked bool
 	LivenessCheckSuccess bool
 	LivenessCheckPublicIP string
+	LivenessCheckCapabilities Capabilities
+	InputBytes int64
+	DreamTaskID string
+	DreamPolled bool
+	DreamProgress DreamProgress
 	DreamDone bool
 	DreamOutputData string
+	DreamFrameData string
+	DreamFinishTime time.Time
+	ZoomNextInput string
+	BudgetChecked bool
+	BudgetAllowsLaunch bool
+}
+
+// Forget the results of all tasks performed so far.
+func (t *taskState) reset() {
+	*t = taskState{}
+}
+
+// Forget the results of the last dream, ready for another.
+func (t *taskState) resetDream() {
+	t.DreamTaskID = ""
+	t.DreamPolled = false
+	t.DreamProgress = DreamProgress{}
+	t.DreamDone = false
+	t.DreamOutputData = ""
+	t.DreamFrameData = ""
+	t.DreamFinishTime = time.Time{}
+	t.ZoomNextInput = ""
 }
 
 // Run a given non-transactional task as part of processing a job.
@@ -48,70 +104,84 @@ func (s *State) doTask(c appengine.Context, task Task, taskState *taskState) (er
 		}
 		taskState.PoolInstancesRetrievedBefore = true
 
-	// If we've been asked to check the liveness of the instance,
-	// do so. If it doesn't respond, wait a while and retry a number of times.
-	// After that the recorded launch time becomes over thirty minutes ago,
-	// we give up and fail the check, otherwise we let the task retry.
-	case TaskCheckLiveness:
+		// Instances are matched to the job by what they can do,
+		// which depends on the size of its input.
+		if s.InputBytes == 0 {
+			if taskState.InputBytes, err = storage.FileSize(c, s.InputData); err != nil {
+				return err
+			}
+		}
 
-		for i := 0; i < 6; i++ {
+	// If we need to launch an instance, check we're within our budget first.
+	case TaskCheckBudget:
+		taskState.BudgetAllowsLaunch, err = launchAllowed(c)
+		if err != nil {
+			return err
+		}
+		taskState.BudgetChecked = true
 
-			// Sleep five seconds before doing the liveness check.
-			time.Sleep(5 * time.Second)
+	// If we've been asked to check the liveness of the instance,
+	// do so. If it doesn't respond, we fail the task, and our retry
+	// policy will have us check again after a while.
+	// After the recorded launch time becomes over thirty minutes ago,
+	// we give up and fail the check.
+	case TaskCheckLiveness:
 
-			resp, checkErr := s.Instance.get(c, "dream")
-			if checkErr == nil {
-				resp.Body.Close()
-				taskState.LivenessChecked = true
-				taskState.LivenessCheckSuccess = true
-				taskState.LivenessCheckPublicIP = strings.Split(
-					resp.Request.URL.Host, ":")[0]
-				break
-			}
+		// Live instances tell us what they can do.
+		caps, ip, checkErr := s.Instance.getCapabilities(c)
+		if checkErr == nil {
+			taskState.LivenessChecked = true
+			taskState.LivenessCheckSuccess = true
+			taskState.LivenessCheckPublicIP = ip
+			taskState.LivenessCheckCapabilities = caps
+			break
 		}
 
-		if !taskState.LivenessCheckSuccess {
-			if time.Now().Add(-30 * time.Minute).After(s.Instance.LaunchTime) {
-				taskState.LivenessChecked = true
-				return nil
-			} else {
-				return errors.New("Gave up liveness checks, try again later.")
-			}
+		if time.Now().Add(-30 * time.Minute).After(s.Instance.LaunchTime) {
+			taskState.LivenessChecked = true
+			return nil
 		}
 
-	case TaskDream:
+		return errors.New("Liveness check failed, try again later: " + checkErr.Error())
+
+	// Pipelines run each step as its own task,
+	// dream steps as TaskDream, so they're retried as dreams.
+	case TaskRunStep:
+		return s.runStep(c, taskState)
 
-		// We need to read the input data, so we can send it to the dream server.
-		inputData, err := storage.ReadFile(c, s.InputData)
+	// Dreams are only submitted here, and polled for until they're done.
+	case TaskDream:
+		taskState.DreamTaskID, err = s.submitDream(c)
 		if err != nil {
 			return err
 		}
 
-		// Try to run the processing job.
-		resp, err := s.Instance.postFile(c, "dream?auth_code=" + s.Instance.AuthCode,
-			"image", inputData)
+	case TaskPollDream:
+		done, progress, err := s.pollDream(c)
 		if err != nil {
 			return err
 		}
-		if resp.StatusCode != http.StatusOK {
-			return errors.New("Processing job failed: " + resp.Status)
+		taskState.DreamPolled = true
+		if !done {
+			taskState.DreamProgress = progress
+			break
 		}
+		taskState.DreamFinishTime = time.Now()
 
-		resultData, err := ioutil.ReadAll(resp.Body)
+		outputData, err := s.fetchDream(c)
 		if err != nil {
 			return err
 		}
-		resp.Body.Close()
 
-		// Now we've done the processing and gotten the result image, save it to storage.
-		outputName := "job/" + s.ID + "/output"
-		outputDataPath, err := storage.WriteFile(c, outputName, resultData)
-		if err != nil {
-			return err
+		// Zoom dreams keep every pass, and only have output after the last.
+		if s.zooming() {
+			if err := s.finishZoomPass(c, outputData, taskState); err != nil {
+				return err
+			}
+		} else {
+			taskState.DreamOutputData = outputData
 		}
-
 		taskState.DreamDone = true
-		taskState.DreamOutputData = outputDataPath
 	}
 
 	return nil
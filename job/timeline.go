@@ -0,0 +1,274 @@
+package job
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// A broad stage of processing a job, covering one or more statuses.
+// Used to see where a job's time went.
+type Stage int
+
+const (
+	StageWaiting Stage = iota
+	StageLaunching
+	StageDreaming
+	StageStoring
+)
+
+// All stages, in the order a job passes through them.
+var Stages = []Stage{
+	StageWaiting,
+	StageLaunching,
+	StageDreaming,
+	StageStoring,
+}
+
+func (stage Stage) String() string {
+	switch stage {
+	case StageWaiting:
+		return "waiting_for_instance"
+	case StageLaunching:
+		return "launching"
+	case StageDreaming:
+		return "dreaming"
+	case StageStoring:
+		return "storing"
+	}
+
+	return "unknown"
+}
+
+func (stage Stage) Description() string {
+	switch stage {
+	case StageWaiting:
+		return "Waiting for dream server"
+	case StageLaunching:
+		return "Launching dream server"
+	case StageDreaming:
+		return "Dreaming"
+	case StageStoring:
+		return "Storing result"
+	}
+
+	return "Unknown"
+}
+
+// Returns the stage a job in the given status is in.
+// Final statuses have no stage, and return false.
+func (status Status) stage() (Stage, bool) {
+	switch status {
+	case StatusNew:
+		return StageWaiting, true
+	case StatusWaitingForInstance:
+		return StageWaiting, true
+	case StatusMustLaunchInstance:
+		return StageLaunching, true
+	case StatusLaunchingInstance:
+		return StageLaunching, true
+	case StatusHaveInstance:
+		return StageDreaming, true
+	case StatusFinishedWithInstance:
+		return StageStoring, true
+	}
+
+	return 0, false
+}
+
+// A period a job spent in one status.
+type TimelineEntry struct {
+	Status Status
+	Start  time.Time
+
+	// How long the job spent in the status.
+	// For the job's current status, this is how long it's been there so far,
+	// or zero if the status is final.
+	Duration time.Duration
+}
+
+// The total time a job spent in one stage.
+type StageDuration struct {
+	Stage    Stage
+	Duration time.Duration
+}
+
+// The history of a job's processing.
+type Timeline struct {
+	Entries []TimelineEntry
+
+	// Time spent in each stage, in the order of Stages.
+	Stages []StageDuration
+}
+
+// Build the timeline of the job from the JobLogs recorded
+// each time its status changed.
+func (s *State) Timeline(c appengine.Context) (timeline *Timeline, err error) {
+
+	q := datastore.NewQuery("JobLog").
+		Ancestor(s.GetKey(c)).
+		Order("Time")
+
+	var logs []JobLog
+	if _, err = q.GetAll(c, &logs); err != nil {
+		return nil, err
+	}
+
+	return s.buildTimeline(logs, time.Now()), nil
+}
+
+func (s *State) buildTimeline(logs []JobLog, now time.Time) *Timeline {
+
+	timeline := &Timeline{
+		Stages: make([]StageDuration, len(Stages)),
+	}
+	for i, stage := range Stages {
+		timeline.Stages[i].Stage = stage
+	}
+
+	// Every job starts as new at its creation time.
+	// Jobs from before we recorded that start at their first change.
+	status := StatusNew
+	start := s.CreateTime
+	if start.IsZero() && len(logs) > 0 {
+		status = logs[0].PrevStatus
+		start = logs[0].Time
+	}
+
+	addEntry := func(end time.Time) {
+		entry := TimelineEntry{
+			Status: status,
+			Start:  start,
+		}
+		if !status.Final() {
+			entry.Duration = end.Sub(start)
+		}
+		timeline.Entries = append(timeline.Entries, entry)
+
+		s.stagePeriods(status, start, end, func(stage Stage, d time.Duration) {
+			timeline.Stages[stage].Duration += d
+		})
+	}
+
+	for _, log := range logs {
+		addEntry(log.Time)
+		status = log.NewStatus
+		start = log.Time
+	}
+	addEntry(now)
+
+	return timeline
+}
+
+// Call add with the stage, or stages, the job spent the given period
+// in the given status in, and how long it spent in each.
+func (s *State) stagePeriods(status Status, start, end time.Time,
+	add func(stage Stage, d time.Duration)) {
+
+	stage, ok := status.stage()
+	if !ok {
+		return
+	}
+
+	// Split the time with an instance between dreaming and storing
+	// the result, if the dream finished during this period.
+	if stage == StageDreaming && s.DreamFinishTime.After(start) &&
+		s.DreamFinishTime.Before(end) {
+
+		add(StageDreaming, s.DreamFinishTime.Sub(start))
+		add(StageStoring, end.Sub(s.DreamFinishTime))
+		return
+	}
+
+	add(stage, end.Sub(start))
+}
+
+// Add the time the job spent in its current status, up to the given time,
+// to the time it's spent in each stage.
+func (s *State) addStageTime(end time.Time) {
+	if len(s.StageSeconds) != len(Stages) || s.StatusTime.IsZero() {
+		return
+	}
+
+	s.stagePeriods(s.Status, s.StatusTime, end, func(stage Stage, d time.Duration) {
+		s.StageSeconds[stage] += d.Seconds()
+	})
+}
+
+// Percentiles of how long jobs spend in one stage.
+type StageLatency struct {
+	Stage Stage
+
+	// Durations at each requested percentile, in the same order.
+	Percentiles []time.Duration
+}
+
+// Returns percentiles of the time spent in each stage,
+// and overall, by the successful jobs among the given number most recently created.
+// Jobs from before we kept the time spent in each stage are left out.
+func LatencyPercentiles(c appengine.Context, limit int, percentiles []float64) (
+	stages []StageLatency, total []time.Duration, err error) {
+
+	jobs, err := RecentJobs(c, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stageDurations := make([][]time.Duration, len(Stages))
+	var totalDurations []time.Duration
+	for _, job := range jobs {
+		if job.Status != StatusDone || len(job.StageSeconds) != len(Stages) {
+			continue
+		}
+
+		for i, seconds := range job.StageSeconds {
+			stageDurations[i] = append(stageDurations[i],
+				time.Duration(seconds*float64(time.Second)))
+		}
+		totalDurations = append(totalDurations, job.Duration())
+	}
+
+	stages = make([]StageLatency, len(Stages))
+	for i, stage := range Stages {
+		stages[i] = StageLatency{
+			Stage:       stage,
+			Percentiles: durationPercentiles(stageDurations[i], percentiles),
+		}
+	}
+
+	return stages, durationPercentiles(totalDurations, percentiles), nil
+}
+
+type durationSlice []time.Duration
+
+func (d durationSlice) Len() int           { return len(d) }
+func (d durationSlice) Less(i, j int) bool { return d[i] < d[j] }
+func (d durationSlice) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// Returns the given percentiles of the durations,
+// using the nearest rank. Zero if there are no durations.
+func durationPercentiles(durations []time.Duration, percentiles []float64) []time.Duration {
+
+	sort.Sort(durationSlice(durations))
+
+	results := make([]time.Duration, len(percentiles))
+	if len(durations) == 0 {
+		return results
+	}
+
+	for i, p := range percentiles {
+		rank := int(math.Ceil(p/100*float64(len(durations)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(durations) {
+			rank = len(durations) - 1
+		}
+		results[i] = durations[rank]
+	}
+
+	return results
+}
@@ -0,0 +1,300 @@
+package job
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/taskqueue"
+	"appengine/urlfetch"
+
+	"config"
+)
+
+// Jobs created with a callback URL have the URL POSTed a JSON payload
+// when they finish, successfully or not, so clients needn't poll.
+//
+// The payload is signed with HMAC-SHA256 using WEBHOOK_SECRET,
+// and the hex encoded signature sent in the X-Dreampics-Signature header.
+// Without a secret, anyone could forge the signature, so callback URLs
+// are refused, and we never send a payload unsigned.
+// Each delivery has an ID, sent in the X-Dreampics-Delivery header,
+// which stays the same across retries, so clients can ignore duplicates.
+
+const (
+	// How long we wait for a callback URL to respond.
+	webhookTimeout = 30 * time.Second
+
+	// The most of a failed response we record.
+	webhookMaxErrorLength = 500
+)
+
+var webhookSecret = config.Get("WEBHOOK_SECRET")
+
+var errNoWebhookSecret = errors.New("Callback URLs aren't available; no webhook secret is configured.")
+
+var webhookRetryPolicy = loadRetryPolicy("webhook", retryPolicy{
+	MaxAttempts:    10,
+	InitialBackoff: 30 * time.Second,
+	MaxBackoff:     time.Hour,
+	Jitter:         0.2,
+})
+
+// Records delivery of a job's webhook for one of its final statuses.
+// Stored as a child entity of the job's state, keyed by the delivery ID.
+type WebhookDelivery struct {
+
+	// The URL we're delivering to.
+	URL string `datastore:",noindex"`
+
+	// The final status the job reached.
+	Status Status
+
+	// The time the delivery was scheduled.
+	CreateTime time.Time
+
+	// The number of times we've tried to deliver the webhook.
+	Attempts int
+
+	// The time of our last attempt. Zero if we've not made one yet.
+	LastAttemptTime time.Time
+
+	// The HTTP status code returned by our last attempt.
+	// Zero if it got no response.
+	LastResponseCode int
+
+	// Why our last attempt failed. Empty if it succeeded.
+	LastError string `datastore:",noindex"`
+
+	// The time the webhook was delivered. Zero if it hasn't been.
+	DeliverTime time.Time
+
+	// Whether we ran out of attempts without delivering the webhook.
+	GaveUp bool
+}
+
+// The JSON payload POSTed to a job's callback URL.
+type webhookPayload struct {
+	ID                string   `json:"id"`
+	Status            string   `json:"status"`
+	StatusDescription string   `json:"status_description"`
+	OutputURLs        []string `json:"output_urls"`
+}
+
+// Check that a callback URL is one we're willing to deliver to.
+func validateCallbackURL(callbackURL string) error {
+
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("Callback URL must be an absolute http or https URL.")
+	}
+	if webhookSecret == "" {
+		return errNoWebhookSecret
+	}
+
+	return nil
+}
+
+// Schedule delivery of the job's webhook, if it has a callback URL,
+// for the final status it's moving to.
+// Must be run in a transaction.
+func (s *State) scheduleWebhook(newStatus Status,
+	c appengine.Context,
+	putKeys *[]*datastore.Key,
+	putData *[]interface{}) {
+
+	if s.CallbackURL == "" {
+		return
+	}
+
+	// Replayed jobs can reach the same status more than once,
+	// and each time deserves its own delivery.
+	deliveryID := fmt.Sprintf("%s-%d", newStatus, s.Replays)
+	delivery := &WebhookDelivery{
+		URL:        s.CallbackURL,
+		Status:     newStatus,
+		CreateTime: time.Now(),
+	}
+
+	*putKeys = append(*putKeys, webhookDeliveryKey(c, s.ID, deliveryID))
+	*putData = append(*putData, delivery)
+
+	deliverWebhookDelay.Call(c, s.ID, deliveryID)
+}
+
+func webhookDeliveryKey(c appengine.Context, jobID, deliveryID string) *datastore.Key {
+	return datastore.NewKey(c, "WebhookDelivery", deliveryID, 0,
+		datastore.NewKey(c, "Job", jobID, 0, nil))
+}
+
+var deliverWebhookDelay *delay.Function
+
+func init() {
+	deliverWebhookDelay = delay.Func("deliverWebhook", deliverWebhook)
+}
+
+// Make one attempt at delivering a job's webhook,
+// scheduling another after a backoff if it fails.
+func deliverWebhook(c appengine.Context, jobID, deliveryID string) error {
+
+	c = withLogFields(c, &logFields{JobID: jobID})
+
+	key := webhookDeliveryKey(c, jobID, deliveryID)
+	delivery := new(WebhookDelivery)
+	if err := datastore.Get(c, key, delivery); err != nil {
+		return err
+	}
+	if !delivery.DeliverTime.IsZero() || delivery.GaveUp {
+		return nil
+	}
+
+	body, err := json.Marshal(webhookPayloadFor(c, jobID, delivery.Status))
+	if err != nil {
+		return err
+	}
+
+	responseCode, deliverErr := postWebhook(c, delivery.URL, deliveryID, body)
+	attemptTime := time.Now()
+
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Get(c, key, delivery); err != nil {
+			return err
+		}
+
+		delivery.Attempts++
+		delivery.LastAttemptTime = attemptTime
+		delivery.LastResponseCode = responseCode
+
+		if deliverErr == nil {
+			c.Infof("Delivered webhook %s on attempt %d.", deliveryID, delivery.Attempts)
+			delivery.LastError = ""
+			delivery.DeliverTime = attemptTime
+			webhookDeliveries.Inc(c, "delivered")
+		} else {
+			c.Warningf("Webhook %s failed on attempt %d of %d: %s",
+				deliveryID, delivery.Attempts, webhookRetryPolicy.MaxAttempts, deliverErr)
+			delivery.LastError = deliverErr.Error()
+
+			if delivery.Attempts < webhookRetryPolicy.MaxAttempts {
+				err := scheduleWebhookRetry(c, jobID, deliveryID,
+					webhookRetryPolicy.backoff(delivery.Attempts))
+				if err != nil {
+					return err
+				}
+			} else {
+				delivery.GaveUp = true
+				webhookDeliveries.Inc(c, "gave_up")
+			}
+		}
+
+		_, err := datastore.Put(c, key, delivery)
+		return err
+	}, nil)
+}
+
+// Build the payload describing the job, as of reaching the given status.
+func webhookPayloadFor(c appengine.Context, jobID string, status Status) *webhookPayload {
+
+	payload := &webhookPayload{
+		ID:                jobID,
+		Status:            status.String(),
+		StatusDescription: status.Description(),
+		OutputURLs:        []string{},
+	}
+
+	if status.OutputReady() {
+		payload.OutputURLs = append(payload.OutputURLs,
+			"https://"+appengine.DefaultVersionHostname(c)+"/job/output/"+jobID)
+	}
+
+	return payload
+}
+
+// POST a signed webhook body to the given URL,
+// returning the response code, and an error unless it was a success.
+func postWebhook(c appengine.Context, callbackURL, deliveryID string, body []byte) (
+	responseCode int, err error) {
+
+	// Jobs may have been given callback URLs before the secret was removed.
+	// We keep retrying, in case it's put back.
+	if webhookSecret == "" {
+		return 0, errNoWebhookSecret
+	}
+
+	req, err := http.NewRequest("POST", callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dreampics-Delivery", deliveryID)
+	req.Header.Set("X-Dreampics-Signature", "sha256="+signWebhook(body))
+
+	client := &http.Client{
+		Transport: &urlfetch.Transport{
+			Context:  c,
+			Deadline: webhookTimeout,
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, webhookMaxErrorLength))
+		return resp.StatusCode, errors.New("Callback URL returned " + resp.Status + ": " +
+			string(message))
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Returns the hex encoded HMAC-SHA256 signature of a webhook body.
+func signWebhook(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Schedule another attempt at delivering a webhook after the given delay.
+// May be run in a transaction, in which case the task is only
+// added if the transaction succeeds.
+func scheduleWebhookRetry(c appengine.Context, jobID, deliveryID string,
+	delay time.Duration) error {
+
+	t, err := deliverWebhookDelay.Task(jobID, deliveryID)
+	if err != nil {
+		return err
+	}
+	t.Delay = delay
+
+	_, err = taskqueue.Add(c, t, "")
+	return err
+}
+
+// Returns the job's webhook deliveries, oldest first.
+func (s *State) WebhookDeliveries(c appengine.Context) (deliveries []WebhookDelivery, err error) {
+	_, err = datastore.NewQuery("WebhookDelivery").
+		Ancestor(s.GetKey(c)).
+		Order("CreateTime").
+		GetAll(c, &deliveries)
+	return deliveries, err
+}
@@ -0,0 +1,153 @@
+package job
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"time"
+
+	"appengine"
+
+	"config"
+	"storage"
+)
+
+// Zoom dreams dream an image repeatedly, zooming in a little on each
+// pass's output and feeding it back in as the next pass's input.
+// Every pass's output is kept as a frame, and the frames are put
+// together into an animation at the end. Passes run one after another
+// on the job's instance while it holds it, rather than each being queued.
+
+var (
+	// The most passes we allow in a zoom dream.
+	maxZoomIterations = config.GetInt("ZOOM_MAX_ITERATIONS", 30)
+)
+
+const (
+	// How much we zoom in between passes if not told.
+	defaultZoomScale = 1.05
+
+	// The most we allow zooming in between passes.
+	maxZoomScale = 2.0
+
+	// How much longer than usual a job may take for each pass after the first.
+	zoomIterationTimeout = 15 * time.Minute
+)
+
+// Check zoom settings are ones we can act on.
+func validateZoom(iterations int, scale float64) error {
+	if iterations == 0 {
+		return nil
+	}
+	if iterations < 2 || iterations > maxZoomIterations {
+		return fmt.Errorf("Zoom dreams must have between 2 and %d passes.", maxZoomIterations)
+	}
+	if scale != 0 && (scale <= 1 || scale > maxZoomScale) {
+		return fmt.Errorf("Zoom scale must be over 1 and at most %g.", maxZoomScale)
+	}
+	return nil
+}
+
+// Returns whether the job is a zoom dream.
+func (s *State) zooming() bool {
+	return s.ZoomIterations > 0
+}
+
+// Record the stored output of a zoom dream's pass, and prepare what comes next:
+// either the input for the next pass, or for the last pass,
+// the animation of every pass.
+// Updates taskState to record results.
+func (s *State) finishZoomPass(c appengine.Context, frameData string, taskState *taskState) error {
+
+	pass := len(s.ZoomFrames)
+	taskState.DreamFrameData = frameData
+
+	if pass+1 < s.ZoomIterations {
+		img, err := readImage(c, frameData)
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, zoomImage(img, s.ZoomScale)); err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("job/%s/zoom-input-%03d", s.ID, pass+1)
+		taskState.ZoomNextInput, err = storage.WriteFile(c, name, buf.Bytes())
+		return err
+	}
+
+	var err error
+	frames := append(append([]string{}, s.ZoomFrames...), frameData)
+	taskState.DreamOutputData, err = writeAnimation(c, "job/"+s.ID+"/output", frames, nil, 0)
+	return err
+}
+
+// Returns the middle of the image, scaled up by the given factor
+// to the size of the original.
+func zoomImage(img image.Image, scale float64) image.Image {
+
+	bounds := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	if scale <= 0 {
+		scale = defaultZoomScale
+	}
+
+	centreX := float64(bounds.Min.X) + float64(bounds.Dx())/2
+	centreY := float64(bounds.Min.Y) + float64(bounds.Dy())/2
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			srcX := centreX + (float64(x)+0.5-float64(bounds.Dx())/2)/scale - 0.5
+			srcY := centreY + (float64(y)+0.5-float64(bounds.Dy())/2)/scale - 0.5
+			out.SetRGBA(x, y, sampleBilinear(img, srcX, srcY))
+		}
+	}
+
+	return out
+}
+
+// Returns the colour of the image at a point between pixels,
+// interpolated from the four pixels around it.
+func sampleBilinear(img image.Image, x, y float64) color.RGBA {
+
+	bounds := img.Bounds()
+	x0 := int(math.Floor(x))
+	y0 := int(math.Floor(y))
+	fx := x - float64(x0)
+	fy := y - float64(y0)
+
+	at := func(x, y int) color.RGBA {
+		if x < bounds.Min.X {
+			x = bounds.Min.X
+		}
+		if x >= bounds.Max.X {
+			x = bounds.Max.X - 1
+		}
+		if y < bounds.Min.Y {
+			y = bounds.Min.Y
+		}
+		if y >= bounds.Max.Y {
+			y = bounds.Max.Y - 1
+		}
+		return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+	}
+
+	c00, c10 := at(x0, y0), at(x0+1, y0)
+	c01, c11 := at(x0, y0+1), at(x0+1, y0+1)
+	mix := func(a, b, c, d uint8) uint8 {
+		top := float64(a)*(1-fx) + float64(b)*fx
+		bottom := float64(c)*(1-fx) + float64(d)*fx
+		return uint8(top*(1-fy) + bottom*fy + 0.5)
+	}
+
+	return color.RGBA{
+		R: mix(c00.R, c10.R, c01.R, c11.R),
+		G: mix(c00.G, c10.G, c01.G, c11.G),
+		B: mix(c00.B, c10.B, c01.B, c11.B),
+		A: mix(c00.A, c10.A, c01.A, c11.A),
+	}
+}
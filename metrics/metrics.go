@@ -0,0 +1,301 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+// Metrics are kept in memcache, since our instances share no memory.
+// This means they may occasionally reset, which Prometheus copes with.
+// Every value a label may take is declared up front,
+// so we know which series to look up when scraped.
+
+const keyPrefix = "metrics:"
+
+// A label a metric is broken down by, with every value it may take.
+type Label struct {
+	Name   string
+	Values []string
+}
+
+type metric interface {
+
+	// The memcache keys holding the metric's values.
+	keys() []string
+
+	// Write the metric in Prometheus text format, given memcache's contents.
+	write(c appengine.Context, buf *bytes.Buffer, values map[string]*memcache.Item) error
+}
+
+var registered []metric
+
+func init() {
+	http.HandleFunc("/metrics", metricsHandler)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	c := appengine.NewContext(r)
+
+	var keys []string
+	for _, m := range registered {
+		keys = append(keys, m.keys()...)
+	}
+
+	values, err := memcache.GetMulti(c, keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, m := range registered {
+		if err := m.write(c, &buf, values); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// A value which only goes up, such as a count of events.
+type Counter struct {
+	name   string
+	help   string
+	labels []Label
+}
+
+func NewCounter(name, help string, labels ...Label) *Counter {
+	m := &Counter{name, help, labels}
+	registered = append(registered, m)
+	return m
+}
+
+func (m *Counter) Inc(c appengine.Context, labelValues ...string) {
+	m.Add(c, 1, labelValues...)
+}
+
+func (m *Counter) Add(c appengine.Context, delta int64, labelValues ...string) {
+	labels, ok := formatLabels(c, m.name, m.labels, labelValues)
+	if !ok {
+		return
+	}
+	increment(c, series(m.name, labels), delta)
+}
+
+func (m *Counter) keys() (keys []string) {
+	for _, labels := range labelSets(m.labels) {
+		keys = append(keys, keyPrefix+series(m.name, labels))
+	}
+	return keys
+}
+
+func (m *Counter) write(c appengine.Context, buf *bytes.Buffer,
+	values map[string]*memcache.Item) error {
+
+	writeHeader(buf, m.name, m.help, "counter")
+	for _, labels := range labelSets(m.labels) {
+		name := series(m.name, labels)
+		fmt.Fprintf(buf, "%s %d\n", name, counterValue(values, keyPrefix+name))
+	}
+	return nil
+}
+
+// A distribution of observed values, such as request latencies.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []Label
+}
+
+// Create a histogram with the given bucket upper bounds, in increasing order.
+func NewHistogram(name, help string, buckets []float64, labels ...Label) *Histogram {
+	m := &Histogram{name, help, buckets, labels}
+	registered = append(registered, m)
+	return m
+}
+
+func (m *Histogram) Observe(c appengine.Context, value float64, labelValues ...string) {
+	labels, ok := formatLabels(c, m.name, m.labels, labelValues)
+	if !ok {
+		return
+	}
+
+	bucket := len(m.buckets)
+	for i, bound := range m.buckets {
+		if value <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	// Memcache only increments integers, so sums are kept in millionths.
+	increment(c, series(m.name+"_bucket", labels)+":"+strconv.Itoa(bucket), 1)
+	increment(c, series(m.name+"_sum", labels), int64(value*1e6))
+	increment(c, series(m.name+"_count", labels), 1)
+}
+
+func (m *Histogram) keys() (keys []string) {
+	for _, labels := range labelSets(m.labels) {
+		for i := 0; i <= len(m.buckets); i++ {
+			keys = append(keys, keyPrefix+series(m.name+"_bucket", labels)+":"+strconv.Itoa(i))
+		}
+		keys = append(keys, keyPrefix+series(m.name+"_sum", labels))
+		keys = append(keys, keyPrefix+series(m.name+"_count", labels))
+	}
+	return keys
+}
+
+func (m *Histogram) write(c appengine.Context, buf *bytes.Buffer,
+	values map[string]*memcache.Item) error {
+
+	writeHeader(buf, m.name, m.help, "histogram")
+	for _, labels := range labelSets(m.labels) {
+
+		// Buckets are stored individually, but exported cumulatively.
+		var cumulative uint64
+		for i := 0; i <= len(m.buckets); i++ {
+			cumulative += counterValue(values,
+				keyPrefix+series(m.name+"_bucket", labels)+":"+strconv.Itoa(i))
+
+			le := "+Inf"
+			if i < len(m.buckets) {
+				le = strconv.FormatFloat(m.buckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(buf, "%s %d\n",
+				series(m.name+"_bucket", joinLabels(labels, `le="`+le+`"`)), cumulative)
+		}
+
+		sum := float64(counterValue(values, keyPrefix+series(m.name+"_sum", labels))) / 1e6
+		fmt.Fprintf(buf, "%s %g\n", series(m.name+"_sum", labels), sum)
+		fmt.Fprintf(buf, "%s %d\n", series(m.name+"_count", labels),
+			counterValue(values, keyPrefix+series(m.name+"_count", labels)))
+	}
+	return nil
+}
+
+// A value computed when scraped, such as the current size of something.
+type GaugeFunc struct {
+	name string
+	help string
+	f    func(c appengine.Context) (float64, error)
+}
+
+func NewGaugeFunc(name, help string, f func(c appengine.Context) (float64, error)) *GaugeFunc {
+	m := &GaugeFunc{name, help, f}
+	registered = append(registered, m)
+	return m
+}
+
+func (m *GaugeFunc) keys() []string {
+	return nil
+}
+
+func (m *GaugeFunc) write(c appengine.Context, buf *bytes.Buffer,
+	values map[string]*memcache.Item) error {
+
+	value, err := m.f(c)
+	if err != nil {
+		return err
+	}
+
+	writeHeader(buf, m.name, m.help, "gauge")
+	fmt.Fprintf(buf, "%s %g\n", m.name, value)
+	return nil
+}
+
+func increment(c appengine.Context, key string, delta int64) {
+	if _, err := memcache.Increment(c, keyPrefix+key, delta, 0); err != nil {
+		c.Warningf("Failed to record metric " + key + ": " + err.Error())
+	}
+}
+
+// Returns the name of the series of the given metric with the given labels.
+func series(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func counterValue(values map[string]*memcache.Item, key string) uint64 {
+	item, ok := values[key]
+	if !ok {
+		return 0
+	}
+
+	value, err := strconv.ParseUint(string(item.Value), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+func writeHeader(buf *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, kind)
+}
+
+// Format the given label values for the metric's labels,
+// refusing values which weren't declared.
+func formatLabels(c appengine.Context, name string, labels []Label, values []string) (
+	formatted string, ok bool) {
+
+	if len(values) != len(labels) {
+		c.Errorf("Wrong number of labels for metric " + name)
+		return "", false
+	}
+
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		declared := false
+		for _, v := range label.Values {
+			if v == values[i] {
+				declared = true
+				break
+			}
+		}
+		if !declared {
+			c.Errorf("Undeclared value " + values[i] + " for label " + label.Name +
+				" of metric " + name)
+			return "", false
+		}
+
+		parts[i] = label.Name + "=" + strconv.Quote(values[i])
+	}
+
+	return strings.Join(parts, ","), true
+}
+
+// Returns every combination of values the given labels may take, formatted.
+func labelSets(labels []Label) []string {
+
+	sets := []string{""}
+	for _, label := range labels {
+		var next []string
+		for _, set := range sets {
+			for _, v := range label.Values {
+				next = append(next, joinLabels(set, label.Name+"="+strconv.Quote(v)))
+			}
+		}
+		sets = next
+	}
+
+	return sets
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
@@ -6,6 +6,12 @@ import (
 
 var (
 	gcsBucket = config.Get("GCS_BUCKET")
+
+	// The most files we keep from one upload.
+	MaxUploadFiles = config.GetInt("UPLOAD_MAX_FILES", 100)
+
+	// The most bytes we accept in one upload, across all its files.
+	maxUploadBytes = int64(config.GetInt("UPLOAD_MAX_BYTES", 256<<20))
 )
 
 func init() {
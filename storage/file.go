@@ -1,15 +1,36 @@
 package storage
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
 	"strings"
 
 	"appengine"
 
 	"google.golang.org/cloud/storage"
+
+	"metrics"
 )
 
+var storageBytes = metrics.NewCounter("dreampics_storage_bytes_total",
+	"Bytes read from and written to cloud storage.",
+	metrics.Label{Name: "direction", Values: []string{"read", "write"}})
+
 func ReadFile(c appengine.Context, gsPath string) (data []byte, err error) {
+	rc, err := OpenFile(c, gsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// Open a file for reading, so it can be streamed
+// rather than read into memory all at once.
+// The caller must close it.
+func OpenFile(c appengine.Context, gsPath string) (rc io.ReadCloser, err error) {
 	ctx, err := getGcsContext(c)
 	if err != nil {
 		return nil, err
@@ -17,32 +38,97 @@ func ReadFile(c appengine.Context, gsPath string) (data []byte, err error) {
 
 	filename := strings.SplitN(gsPath, "/", 4)[3]
 
-	rc, err := storage.NewReader(ctx, gcsBucket, filename)
+	rc, err = storage.NewReader(ctx, gcsBucket, filename)
 	if err != nil {
 		return nil, err
 	}
 
-	data, err = ioutil.ReadAll(rc)
-	rc.Close()
+	return &countingReader{c: c, rc: rc}, nil
+}
+
+// Returns the size of a file, in bytes.
+func FileSize(c appengine.Context, gsPath string) (size int64, err error) {
+	ctx, err := getGcsContext(c)
+	if err != nil {
+		return 0, err
+	}
+
+	filename := strings.SplitN(gsPath, "/", 4)[3]
+
+	obj, err := storage.StatObject(ctx, gcsBucket, filename)
+	if err != nil {
+		return 0, err
+	}
+
+	return obj.Size, nil
+}
+
+// Delete the given files. If any can't be deleted, still tries the rest,
+// returning the last error.
+func DeleteFiles(c appengine.Context, gsPaths []string) (err error) {
+	ctx, err := getGcsContext(c)
+	if err != nil {
+		return err
+	}
+
+	for _, gsPath := range gsPaths {
+		filename := strings.SplitN(gsPath, "/", 4)[3]
+		if newErr := storage.DeleteObject(ctx, gcsBucket, filename); newErr != nil {
+			err = newErr
+		}
+	}
+
+	return err
+}
+
+// Counts the bytes read from a file, for our metrics, once it's closed.
+type countingReader struct {
+	c  appengine.Context
+	rc io.ReadCloser
+	n  int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.rc.Read(p)
+	r.n += int64(n)
 	return
 }
 
+func (r *countingReader) Close() error {
+	storageBytes.Add(r.c, r.n, "read")
+	return r.rc.Close()
+}
+
 func WriteFile(c appengine.Context, filename string, data []byte) (gsPath string, err error) {
+	return WriteFileType(c, filename, "image/png", data)
+}
+
+// Write a file of the given content type.
+func WriteFileType(c appengine.Context, filename, contentType string, data []byte) (gsPath string, err error) {
+	return WriteFileFrom(c, filename, contentType, bytes.NewReader(data))
+}
+
+// Write a file of the given content type, streaming its contents from r,
+// so they needn't be held in memory all at once.
+func WriteFileFrom(c appengine.Context, filename, contentType string, r io.Reader) (gsPath string, err error) {
 	ctx, err := getGcsContext(c)
 	if err != nil {
 		return "", err
 	}
 
 	wc := storage.NewWriter(ctx, gcsBucket, filename)
-	wc.ContentType = "image/png"
+	wc.ContentType = contentType
 
-	if _, err = wc.Write(data); err != nil {
+	n, err := io.Copy(wc, r)
+	if err != nil {
+		wc.CloseWithError(err)
 		return "", err
 	}
 
 	if err = wc.Close(); err != nil {
 		return "", err
 	}
+	storageBytes.Add(c, n, "write")
 
 	return "/gs/" + gcsBucket + "/" + filename, nil
 }
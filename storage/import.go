@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/socket"
+	"appengine/urlfetch"
+
+	"config"
+)
+
+// Images can be imported from elsewhere on the web, rather than uploaded.
+// We fetch them ourselves, so we're careful what we fetch: only images,
+// only so big, only so slowly, and never from private addresses,
+// so imports can't be used to probe networks only we can reach.
+
+var (
+	// The biggest image we import.
+	maxImportBytes = int64(config.GetInt("IMPORT_MAX_BYTES", 20<<20))
+
+	// How long we wait for an image to be fetched.
+	importTimeout = config.GetDuration("IMPORT_TIMEOUT", 30*time.Second)
+)
+
+// How many redirects we follow when importing an image.
+const maxImportRedirects = 5
+
+// The content types of images we import.
+var importContentTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// Fetch the image at the given URL, and store it as though it had been
+// uploaded, returning its storage name.
+func ImportURL(c appengine.Context, sourceURL string) (storageName string, err error) {
+
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return "", err
+	}
+	if err := checkImportURL(c, u); err != nil {
+		return "", err
+	}
+
+	client := &http.Client{
+		Transport: &urlfetch.Transport{
+			Context:  c,
+			Deadline: importTimeout,
+		},
+
+		// Wherever we're redirected must pass the same checks.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxImportRedirects {
+				return errors.New("Too many redirects.")
+			}
+			return checkImportURL(c, req.URL)
+		},
+	}
+
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("Fetching image failed: " + resp.Status)
+	}
+	if resp.ContentLength > maxImportBytes {
+		return "", importTooBig()
+	}
+
+	// Don't trust the content length, in case it's missing or lying.
+	body := bufio.NewReader(&importLimitReader{r: resp.Body, n: maxImportBytes})
+
+	// Check both what we were told we got, and what we actually got,
+	// going by the start of it, before storing any of it.
+	head, err := body.Peek(512)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	contentType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if !importContentTypes[contentType] || http.DetectContentType(head) != contentType {
+		return "", errors.New("URL isn't a GIF, JPEG or PNG image.")
+	}
+
+	name, err := importName()
+	if err != nil {
+		return "", err
+	}
+
+	// The image is stored as it arrives, rather than held in memory.
+	return WriteFileFrom(c, "upload/"+name, contentType, body)
+}
+
+// Reads from r, failing once more than n bytes have been read.
+type importLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *importLimitReader) Read(p []byte) (n int, err error) {
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, importTooBig()
+	}
+	return n, err
+}
+
+func importTooBig() error {
+	return fmt.Errorf("Image is too big; the most we import is %d MB.", maxImportBytes>>20)
+}
+
+// Check we're willing to fetch the given URL.
+func checkImportURL(c appengine.Context, u *url.URL) error {
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("Image URL must be an absolute http or https URL.")
+	}
+
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = socket.LookupIP(c, host); err != nil {
+			return err
+		}
+		if len(ips) == 0 {
+			return errors.New("Image URL's host has no addresses.")
+		}
+	}
+
+	// The host could resolve differently when actually fetched,
+	// but this stops anything simply pointing at a private address.
+	for _, ip := range ips {
+		if privateIP(ip) {
+			return errors.New("Image URL must not be for a private address.")
+		}
+	}
+
+	return nil
+}
+
+// The address ranges which aren't reachable on the public internet.
+var privateNetworks = []*net.IPNet{
+	parseCIDR("0.0.0.0/8"),
+	parseCIDR("10.0.0.0/8"),
+	parseCIDR("100.64.0.0/10"),
+	parseCIDR("127.0.0.0/8"),
+	parseCIDR("169.254.0.0/16"),
+	parseCIDR("172.16.0.0/12"),
+	parseCIDR("192.168.0.0/16"),
+	parseCIDR("::1/128"),
+	parseCIDR("fc00::/7"),
+	parseCIDR("fe80::/10"),
+}
+
+func parseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// Returns whether the address is private, or otherwise not one to fetch from.
+func privateIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a random name for an imported image.
+func importName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 
@@ -39,51 +40,145 @@ func getGcsContext(c appengine.Context) (ctx context.Context, err error) {
 
 func GetUploadURL(c appengine.Context, handler string) (url *url.URL, err error) {
 	return blobstore.UploadURL(c, handler, &blobstore.UploadURLOptions{
-		StorageBucket: gcsBucket + "/upload/",
+		StorageBucket:  gcsBucket + "/upload/",
+		MaxUploadBytes: maxUploadBytes,
 	})
 }
 
 func HandleUpload(r *http.Request) (storageName string, other url.Values, err error) {
-	blobs, other, err := blobstore.ParseUpload(r)
+	storageNames, other, err := HandleUploads(r, 1)
 	if err != nil {
 		return "", nil, err
 	}
 
-	// Delete any uploads other than the one we actually want.
+	return storageNames[0], other, nil
+}
+
+// Handle an upload of several files, returning the storage names
+// of up to max of them, in the order they were uploaded.
+// We never keep more than MaxUploadFiles, however large max is.
+func HandleUploads(r *http.Request, max int) (storageNames []string, other url.Values, err error) {
+	files, other, err := handleUploadFields(r, map[string]int{"file": max})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(files["file"]) == 0 {
+		return nil, nil, errors.New("No file uploaded.")
+	}
+
+	return files["file"], other, nil
+}
+
+// Handle an upload of an optional file, along with an optional guide image
+// in the "guide" field, returning their storage names.
+// Either storage name is empty if that file wasn't uploaded.
+func HandleGuidedUpload(r *http.Request) (storageName, guideName string, other url.Values, err error) {
+	files, other, err := handleUploadFields(r, map[string]int{"file": 1, "guide": 1})
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	if len(files["file"]) > 0 {
+		storageName = files["file"][0]
+	}
+	if len(files["guide"]) > 0 {
+		guideName = files["guide"][0]
+	}
+	return storageName, guideName, other, nil
+}
+
+// Handle an upload which may or may not include a file,
+// returning its storage name, or an empty one if none was uploaded.
+func HandleOptionalUpload(r *http.Request) (storageName string, other url.Values, err error) {
+	files, other, err := handleUploadFields(r, map[string]int{"file": 1})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(files["file"]) > 0 {
+		storageName = files["file"][0]
+	}
+	return storageName, other, nil
+}
+
+// Handle an upload, keeping up to the given number of files from each
+// of the given fields, and returning their storage names by field,
+// in the order they were uploaded.
+// Fails, keeping nothing, if the files we'd keep are too many or too big.
+func handleUploadFields(r *http.Request, fields map[string]int) (
+	files map[string][]string, other url.Values, err error) {
+
+	blobs, other, err := blobstore.ParseUpload(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Delete any uploads other than the ones we actually want.
 	// Stops users from wasting our storage for no reason.
 	var deleteList []string
+	var keepList []string
+	var count int
+	var size int64
+	files = make(map[string][]string)
 	for k, fileList := range blobs {
 		for i, file := range fileList {
-			if k != "file" || i != 0 {
+			if i >= fields[k] {
 				deleteList = append(deleteList, file.ObjectName)
+				continue
 			}
+
+			files[k] = append(files[k], file.ObjectName)
+			keepList = append(keepList, file.ObjectName)
+			count++
+			size += file.Size
 		}
 	}
-	if len(deleteList) > 0 {
 
-		c := appengine.NewContext(r)
-		ctx, err := getGcsContext(c)
-		if err != nil {
-			return "", nil, err
-		}
+	// Our upload URLs limit the size of uploads themselves,
+	// but what we keep is checked here too, as a user could get
+	// an upload URL for one handler, and post to it for another.
+	var limitErr error
+	if count > MaxUploadFiles {
+		limitErr = fmt.Errorf("Too many files uploaded; the most we accept is %d.", MaxUploadFiles)
+	} else if size > maxUploadBytes {
+		limitErr = fmt.Errorf("Files uploaded are too big; the most we accept is %d MB in total.",
+			maxUploadBytes>>20)
+	}
+	if limitErr != nil {
+		deleteList = append(deleteList, keepList...)
+	}
 
-		for _, junk := range deleteList {
+	if err := deleteUploads(r, deleteList); err != nil {
+		return nil, nil, err
+	}
+	if limitErr != nil {
+		return nil, nil, limitErr
+	}
 
-			// If one of our delete ops fails, still try the rest,
-			// but set err aside, preserving it, so we can return
-			// after.
-			if newErr := storage.DeleteObject(ctx, gcsBucket, junk); err != nil {
-				err = newErr
-			}
-		}
+	return files, other, nil
+}
+
+// Delete the given uploaded objects.
+func deleteUploads(r *http.Request, names []string) (err error) {
+	if len(names) == 0 {
+		return nil
 	}
+
+	c := appengine.NewContext(r)
+	ctx, err := getGcsContext(c)
 	if err != nil {
-		return "", nil, err
+		return err
 	}
 
-	if len(blobs["file"]) == 0 {
-		return "", nil, errors.New("No file uploaded.")
+	for _, junk := range names {
+
+		// If one of our delete ops fails, still try the rest,
+		// but set err aside, preserving it, so we can return
+		// after.
+		if newErr := storage.DeleteObject(ctx, gcsBucket, junk); newErr != nil {
+			err = newErr
+		}
 	}
 
-	return blobs["file"][0].ObjectName, other, nil
+	return err
 }
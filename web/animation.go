@@ -0,0 +1,119 @@
+package web
+
+import (
+	"html/template"
+	"net/http"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+
+	"job"
+)
+
+var (
+	animationTemplate = template.Must(template.ParseFiles("web/animation.html"))
+)
+
+func init() {
+	http.HandleFunc("/animation/input/", animationInputHandler)
+	http.HandleFunc("/animation/output/", animationOutputHandler)
+	http.HandleFunc("/animation/", animationHandler)
+}
+
+// Loads the animation with the given ID,
+// writing an error response and returning nil if that fails.
+func getAnimation(w http.ResponseWriter, c appengine.Context, id string) *job.Animation {
+
+	a := &job.Animation{ID: id}
+	if err := datastore.Get(c, a.GetKey(c), a); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "No such animation", http.StatusNotFound)
+			return nil
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	return a
+}
+
+func animationInputHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	id := path[17:]
+
+	c := appengine.NewContext(r)
+
+	a := getAnimation(w, c, id)
+	if a == nil {
+		return
+	}
+
+	sendAnimationFile(w, c, a.InputData)
+}
+
+func animationOutputHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	id := path[18:]
+
+	c := appengine.NewContext(r)
+
+	a := getAnimation(w, c, id)
+	if a == nil {
+		return
+	}
+
+	if a.OutputData == "" {
+		http.Error(w, "No processing output", http.StatusBadRequest)
+		return
+	}
+
+	sendAnimationFile(w, c, a.OutputData)
+}
+
+func sendAnimationFile(w http.ResponseWriter, c appengine.Context, gsPath string) {
+	blobKey, err := blobstore.BlobKeyForFile(c, gsPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public,max-age:60000")
+	blobstore.Send(w, blobKey)
+}
+
+func animationHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	id := path[11:]
+
+	c := appengine.NewContext(r)
+
+	a := getAnimation(w, c, id)
+	if a == nil {
+		return
+	}
+
+	// Frames only exist once the animation has been split.
+	var progress job.BatchProgress
+	if a.Status != job.AnimationSplitting {
+		jobs, err := (&job.Batch{ID: id}).Jobs(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		progress = job.NewBatchProgress(jobs)
+	}
+
+	err := animationTemplate.Execute(w, &struct {
+		Animation *job.Animation
+		Finished  bool
+		Progress  job.BatchProgress
+	}{
+		a,
+		a.Status == job.AnimationDone || a.Status == job.AnimationFailed,
+		progress,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
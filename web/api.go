@@ -0,0 +1,278 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+
+	"job"
+	"storage"
+)
+
+func init() {
+	http.HandleFunc("/api/job/", apiJobHandler)
+	http.HandleFunc("/api/batch/create", apiBatchCreateHandler)
+	http.HandleFunc("/api/batch/", apiBatchHandler)
+}
+
+type apiTimelineEntry struct {
+	Status          string    `json:"status"`
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+type apiStageDuration struct {
+	Stage           string  `json:"stage"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+type apiJob struct {
+	ID                string             `json:"id"`
+	Status            string             `json:"status"`
+	StatusDescription string             `json:"status_description"`
+	OutputReady       bool               `json:"output_ready"`
+	Preset            string             `json:"preset,omitempty"`
+	Progress          *apiProgress       `json:"progress,omitempty"`
+	Timeline          []apiTimelineEntry `json:"timeline"`
+	Stages            []apiStageDuration `json:"stages"`
+}
+
+type apiProgress struct {
+	Percent          int        `json:"percent"`
+	Octave           int        `json:"octave,omitempty"`
+	Octaves          int        `json:"octaves,omitempty"`
+	Iteration        int        `json:"iteration,omitempty"`
+	Iterations       int        `json:"iterations,omitempty"`
+	ETA              *time.Time `json:"eta,omitempty"`
+	RemainingSeconds float64    `json:"remaining_seconds,omitempty"`
+	UpdateTime       time.Time  `json:"update_time"`
+}
+
+// How many images we import at once when creating a batch.
+const apiBatchImportConcurrency = 4
+
+type apiBatchCreate struct {
+	ImageURLs []string `json:"image_urls"`
+	Preset    string   `json:"preset"`
+}
+
+type apiBatchCreated struct {
+	ID string `json:"id"`
+}
+
+type apiBatchJob struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+type apiBatch struct {
+	ID                string        `json:"id"`
+	Status            string        `json:"status"`
+	StatusDescription string        `json:"status_description"`
+	Total             int           `json:"total"`
+	Queued            int           `json:"queued"`
+	Running           int           `json:"running"`
+	Done              int           `json:"done"`
+	Failed            int           `json:"failed"`
+	Jobs              []apiBatchJob `json:"jobs"`
+}
+
+// Returns the state of a job as JSON, for API clients.
+func apiJobHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	jobID := path[9:]
+
+	c := appengine.NewContext(r)
+
+	state := &job.State{ID: jobID}
+	if err := datastore.Get(c, state.GetKey(c), state); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "No such job", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	timeline, err := state.Timeline(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := &apiJob{
+		ID:                state.ID,
+		Status:            state.Status.String(),
+		StatusDescription: state.Status.Description(),
+		OutputReady:       state.Status.OutputReady(),
+		Preset:            state.Preset,
+		Timeline:          make([]apiTimelineEntry, len(timeline.Entries)),
+		Stages:            make([]apiStageDuration, len(timeline.Stages)),
+	}
+	if p := state.DreamProgress; state.DreamRunning() && p.Known() {
+		result.Progress = &apiProgress{
+			Percent:          p.Percent(),
+			Octave:           p.Octave,
+			Octaves:          p.Octaves,
+			Iteration:        p.Iteration,
+			Iterations:       p.Iterations,
+			RemainingSeconds: p.Remaining().Seconds(),
+			UpdateTime:       p.UpdateTime,
+		}
+		if !p.ETA.IsZero() {
+			result.Progress.ETA = &p.ETA
+		}
+	}
+	for i, entry := range timeline.Entries {
+		result.Timeline[i] = apiTimelineEntry{
+			Status:          entry.Status.String(),
+			Start:           entry.Start,
+			DurationSeconds: entry.Duration.Seconds(),
+		}
+	}
+	for i, stage := range timeline.Stages {
+		result.Stages[i] = apiStageDuration{
+			Stage:           stage.Stage.String(),
+			DurationSeconds: stage.Duration.Seconds(),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Returns the state of a batch and its jobs as JSON, for API clients.
+func apiBatchHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	batchID := path[11:]
+
+	c := appengine.NewContext(r)
+
+	batch, jobs := getBatch(w, c, batchID)
+	if batch == nil {
+		return
+	}
+
+	progress := job.NewBatchProgress(jobs)
+	status := progress.Status()
+	result := &apiBatch{
+		ID:                batch.ID,
+		Status:            status.String(),
+		StatusDescription: status.Description(),
+		Total:             progress.Total,
+		Queued:            progress.Queued,
+		Running:           progress.Running,
+		Done:              progress.Done,
+		Failed:            progress.Failed,
+		Jobs:              make([]apiBatchJob, len(jobs)),
+	}
+	for i, s := range jobs {
+		result.Jobs[i] = apiBatchJob{
+			ID:     s.ID,
+			Status: s.Status.String(),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Creates a batch from a JSON list of image URLs, importing each image,
+// and returns the new batch's ID as JSON, for API clients.
+func apiBatchCreateHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "Batches must be created with POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request apiBatchCreate
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.ImageURLs) == 0 {
+		http.Error(w, "No image URLs given.", http.StatusBadRequest)
+		return
+	}
+	if len(request.ImageURLs) > job.MaxBatchJobs {
+		http.Error(w, fmt.Sprintf("Too many images in batch; the most we accept is %d.",
+			job.MaxBatchJobs), http.StatusBadRequest)
+		return
+	}
+
+	c := appengine.NewContext(r)
+
+	// Import a few images at once, so a big batch doesn't take
+	// as long as all its imports one after another.
+	storageNames := make([]string, len(request.ImageURLs))
+	errs := make([]error, len(request.ImageURLs))
+	sem := make(chan struct{}, apiBatchImportConcurrency)
+	var wg sync.WaitGroup
+	for i, imageURL := range request.ImageURLs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, imageURL string) {
+			defer wg.Done()
+			storageNames[i], errs[i] = storage.ImportURL(c, imageURL)
+			<-sem
+		}(i, imageURL)
+	}
+	wg.Wait()
+
+	// If any import failed, nothing will use the images we did import.
+	var imported []string
+	var importErr error
+	for i, err := range errs {
+		if err != nil && importErr == nil {
+			importErr = fmt.Errorf("Importing image %d failed: %s", i+1, err)
+		}
+		if storageNames[i] != "" {
+			imported = append(imported, storageNames[i])
+		}
+	}
+	if importErr != nil {
+		if err := storage.DeleteFiles(c, imported); err != nil {
+			c.Errorf("Failed to delete imported images: %s", err)
+		}
+		http.Error(w, importErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options := job.Options{
+		Preset: request.Preset,
+	}
+	if u := user.Current(c); u != nil {
+		options.User = u.Email
+	}
+
+	id, err := job.CreateBatch(c, storageNames, options)
+	if err != nil {
+		if err := storage.DeleteFiles(c, storageNames); err != nil {
+			c.Errorf("Failed to delete imported images: %s", err)
+		}
+		if _, ok := err.(*job.ValidationError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/batch/"+id)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(&apiBatchCreated{ID: id}); err != nil {
+		c.Errorf("Failed to write response: %s", err)
+	}
+}
@@ -0,0 +1,98 @@
+package web
+
+import (
+	"html/template"
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+
+	"job"
+)
+
+var (
+	batchTemplate = template.Must(template.ParseFiles("web/batch.html"))
+)
+
+func init() {
+	http.HandleFunc("/batch/outputs/", batchOutputsHandler)
+	http.HandleFunc("/batch/", batchHandler)
+}
+
+// Loads the batch with the given ID and its jobs,
+// writing an error response and returning nil if that fails.
+func getBatch(w http.ResponseWriter, c appengine.Context, batchID string) (
+	*job.Batch, []*job.State) {
+
+	batch := &job.Batch{ID: batchID}
+	if err := datastore.Get(c, batch.GetKey(c), batch); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "No such batch", http.StatusNotFound)
+			return nil, nil
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	jobs, err := batch.Jobs(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	return batch, jobs
+}
+
+// Sends a zip file of the outputs of a batch's finished jobs.
+func batchOutputsHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	batchID := path[15:]
+
+	c := appengine.NewContext(r)
+
+	batch, jobs := getBatch(w, c, batchID)
+	if batch == nil {
+		return
+	}
+
+	if job.NewBatchProgress(jobs).Done == 0 {
+		http.Error(w, "No processing output", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="dreams.zip"`)
+	if err := job.WriteBatchOutputs(c, w, jobs); err != nil {
+		c.Errorf("Failed to write batch outputs: %s", err)
+	}
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	batchID := path[7:]
+
+	c := appengine.NewContext(r)
+
+	batch, jobs := getBatch(w, c, batchID)
+	if batch == nil {
+		return
+	}
+
+	progress := job.NewBatchProgress(jobs)
+	err := batchTemplate.Execute(w, &struct {
+		BatchID  string
+		Status   job.BatchStatus
+		Running  bool
+		Progress job.BatchProgress
+		Jobs     []*job.State
+	}{
+		batchID,
+		progress.Status(),
+		progress.Status() == job.BatchRunning,
+		progress,
+		jobs,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
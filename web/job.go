@@ -3,6 +3,9 @@ package web
 import (
 	"html/template"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"appengine"
 	"appengine/blobstore"
@@ -12,12 +15,19 @@ import (
 )
 
 var (
-	jobTemplate = template.Must(template.ParseFiles("web/job.html"))
+	jobTemplate = template.Must(template.New("job.html").
+		Funcs(template.FuncMap{
+			"duration": roundDuration,
+		}).
+		ParseFiles("web/job.html"))
 )
 
 func init() {
 	http.HandleFunc("/job/input/", jobInputHandler)
+	http.HandleFunc("/job/guide/", jobGuideHandler)
 	http.HandleFunc("/job/output/", jobOutputHandler)
+	http.HandleFunc("/job/zoom/", jobZoomFrameHandler)
+	http.HandleFunc("/job/step/", jobStepOutputHandler)
 	http.HandleFunc("/job/", jobHandler)
 }
 
@@ -45,6 +55,33 @@ func jobInputHandler(w http.ResponseWriter, r *http.Request) {
 	blobstore.Send(w, blobKey)
 }
 
+func jobGuideHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	jobID := path[11:]
+
+	c := appengine.NewContext(r)
+
+	state := &job.State{ID: jobID}
+	if err := datastore.Get(c, state.GetKey(c), state); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if state.GuideData == "" {
+		http.Error(w, "No guide image", http.StatusNotFound)
+		return
+	}
+
+	blobKey, err := blobstore.BlobKeyForFile(c, state.GuideData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public,max-age:60000")
+	blobstore.Send(w, blobKey)
+}
+
 func jobOutputHandler(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	jobID := path[12:]
@@ -69,6 +106,60 @@ func jobOutputHandler(w http.ResponseWriter, r *http.Request) {
 	blobstore.Send(w, blobKey)
 }
 
+// Sends one of the frames of a zoom dream, at /job/zoom/{id}/{frame}.
+func jobZoomFrameHandler(w http.ResponseWriter, r *http.Request) {
+	sendJobArtifact(w, r, "/job/zoom/", func(s *job.State) []string {
+		return s.ZoomFrames
+	})
+}
+
+// Sends the output of one of a job's pipeline steps, at /job/step/{id}/{step}.
+func jobStepOutputHandler(w http.ResponseWriter, r *http.Request) {
+	sendJobArtifact(w, r, "/job/step/", func(s *job.State) []string {
+		return s.StepOutputs
+	})
+}
+
+// Sends one of a list of files stored for a job, at {prefix}{id}/{index}.
+func sendJobArtifact(w http.ResponseWriter, r *http.Request, prefix string,
+	files func(s *job.State) []string) {
+
+	parts := strings.Split(r.URL.Path[len(prefix):], "/")
+	if len(parts) != 2 {
+		http.Error(w, "No such file", http.StatusNotFound)
+		return
+	}
+	jobID := parts[0]
+	index, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.Error(w, "No such file", http.StatusNotFound)
+		return
+	}
+
+	c := appengine.NewContext(r)
+
+	state := &job.State{ID: jobID}
+	if err := datastore.Get(c, state.GetKey(c), state); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	list := files(state)
+	if index < 0 || index >= len(list) {
+		http.Error(w, "No such file", http.StatusNotFound)
+		return
+	}
+
+	blobKey, err := blobstore.BlobKeyForFile(c, list[index])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public,max-age:60000")
+	blobstore.Send(w, blobKey)
+}
+
 func jobHandler(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	jobID := path[5:]
@@ -80,18 +171,49 @@ func jobHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 
-	err := jobTemplate.Execute(w, &struct{
+	timeline, err := state.Timeline(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var progress *job.DreamProgress
+	if state.DreamRunning() {
+		progress = &state.DreamProgress
+	}
+
+	err = jobTemplate.Execute(w, &struct{
 		JobID string
 		StatusDescription string
+		Progress *job.DreamProgress
 		ShowInputImage bool
+		ShowGuideImage bool
+		Preset string
 		ShowOutputImage bool
+		Timeline *job.Timeline
+		ZoomFrames []string
+		ZoomIterations int
+		Pipeline []job.PipelineStep
+		StepOutputs []string
 	}{
 		jobID,
 		state.Status.Description(),
+		progress,
 		true,
+		state.GuideData != "",
+		state.Preset,
 		state.Status.OutputReady(),
+		timeline,
+		state.ZoomFrames,
+		state.ZoomIterations,
+		state.Pipeline,
+		state.StepOutputs,
 	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+func roundDuration(d time.Duration) time.Duration {
+	return d - d%time.Second
+}